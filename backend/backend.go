@@ -1,14 +1,27 @@
 package backend
 
-import "github.com/venkytv/botmand/message"
+import (
+	"io"
 
-const QBufferSize = 100
+	"github.com/venkytv/botmand/message"
+)
+
+const DefaultQBufferSize = 100
 
 type Backender interface {
 	Name() string
 	Read()
 	Post()
-	Sanitize(*message.Message) *message.Message
+	Sanitize(*message.Message, message.SanitizeOptions) *message.Message
+	DownloadFile(url string, w io.Writer) error
+	InUserGroup(user string, group string) bool
+
+	// Look up the name and type of a channel, given its ID
+	LookupChannel(channelId string) (name string, channelType string)
+
+	// Block while messages to a channel are backed up, then hold space
+	// for the next message posted to it
+	WaitToPost(channelId string)
 }
 
 type BackendQueues struct {
@@ -16,9 +29,12 @@ type BackendQueues struct {
 	RespQ chan *message.Message
 }
 
-func NewBackendQueues() BackendQueues {
+func NewBackendQueues(size int) BackendQueues {
+	if size < 1 {
+		size = DefaultQBufferSize
+	}
 	return BackendQueues{
-		MesgQ: make(chan *message.Message, QBufferSize),
-		RespQ: make(chan *message.Message, QBufferSize),
+		MesgQ: make(chan *message.Message, size),
+		RespQ: make(chan *message.Message, size),
 	}
 }
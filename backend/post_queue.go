@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/venkytv/botmand/globals"
+	"github.com/venkytv/botmand/message"
+)
+
+// How long a channel's post worker waits for messages before stopping
+const postWorkerIdle = 1 * time.Minute
+
+// PostQueue fans outbound messages out to one worker per channel.
+// Messages to a channel are posted in order, but a slow API call for one
+// channel does not hold up messages to other channels.
+//
+// Each channel's queue holds at most size messages from producers which
+// Wait for space before posting.
+type PostQueue struct {
+	size    int
+	idle    time.Duration
+	post    func(*message.Message)
+	workers map[string]*postWorker
+	lock    *sync.Mutex
+	wg      *sync.WaitGroup
+	closed  bool
+
+	// Space reserved in each channel's queue by Wait, for messages not
+	// enqueued yet
+	reserved map[string]int
+
+	// Signalled when messages are taken off a channel's queue
+	space *sync.Cond
+}
+
+// Messages waiting to be posted to a channel
+type postWorker struct {
+	pending []*message.Message
+
+	// Signalled when messages are queued
+	wake chan struct{}
+}
+
+func NewPostQueue(size int, post func(*message.Message)) *PostQueue {
+	if size < 1 {
+		size = DefaultQBufferSize
+	}
+	lock := &sync.Mutex{}
+	return &PostQueue{
+		size:     size,
+		idle:     postWorkerIdle,
+		post:     post,
+		workers:  make(map[string]*postWorker),
+		lock:     lock,
+		wg:       &sync.WaitGroup{},
+		reserved: make(map[string]int),
+		space:    sync.NewCond(lock),
+	}
+}
+
+func (w *postWorker) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Take the next message off a channel's queue, waiting for one if needed.
+// Returns nil once the worker has stopped, either because the queue has been
+// closed or because there were no messages for a while.
+func (pq *PostQueue) next(channel string, w *postWorker) *message.Message {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	for len(w.pending) < 1 {
+		if pq.closed {
+			pq.stopWorker(channel)
+			return nil
+		}
+
+		pq.lock.Unlock()
+		idle := false
+		select {
+		case <-w.wake:
+		case <-time.After(pq.idle):
+			idle = true
+		}
+		pq.lock.Lock()
+
+		// Messages may have been queued while waiting
+		if idle && len(w.pending) < 1 {
+			logrus.Debugf("Post worker for channel %s idle", channel)
+			pq.stopWorker(channel)
+			return nil
+		}
+	}
+
+	msg := w.pending[0]
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	pq.space.Broadcast()
+	return msg
+}
+
+// Needs the lock held
+func (pq *PostQueue) stopWorker(channel string) {
+	delete(pq.workers, channel)
+	globals.NumPostWorkers.Dec()
+}
+
+func (pq *PostQueue) work(channel string, w *postWorker) {
+	defer pq.wg.Done()
+	for msg := pq.next(channel, w); msg != nil; msg = pq.next(channel, w) {
+		globals.PostQueueDepth.Dec()
+		pq.post(msg)
+	}
+	logrus.Debugf("Post worker for channel %s done", channel)
+}
+
+// Enqueue queues a message for posting, starting a worker for the channel if
+// needed. Enqueue never blocks, so that a slow channel can't hold up the
+// others; use Wait to hold back messages to a channel whose queue is full.
+func (pq *PostQueue) Enqueue(msg *message.Message) {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	// The message takes up the space reserved for it, if any
+	if pq.reserved[msg.ChannelId] > 1 {
+		pq.reserved[msg.ChannelId]--
+	} else {
+		delete(pq.reserved, msg.ChannelId)
+	}
+
+	w, exists := pq.workers[msg.ChannelId]
+	if !exists {
+		w = &postWorker{wake: make(chan struct{}, 1)}
+		pq.workers[msg.ChannelId] = w
+		globals.NumPostWorkers.Inc()
+
+		pq.wg.Add(1)
+		go pq.work(msg.ChannelId, w)
+	}
+
+	w.pending = append(w.pending, msg)
+	globals.PostQueueDepth.Inc()
+	if len(w.pending) > pq.size {
+		// Only messages enqueued without waiting for space can overfill
+		// the queue
+		logrus.Warnf("Post queue full for channel %s: %d messages", msg.ChannelId, len(w.pending))
+	}
+	w.signal()
+}
+
+// Wait blocks while the queue for a channel is full, so that whoever is
+// posting to a slow channel is held back without holding up other channels.
+// Space is reserved in the queue for the caller's next message to the
+// channel, so that concurrent callers can't overfill it.
+func (pq *PostQueue) Wait(channel string) {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	blocked := false
+	for !pq.closed {
+		queued := pq.reserved[channel]
+		if w, exists := pq.workers[channel]; exists {
+			queued += len(w.pending)
+		}
+		if queued < pq.size {
+			pq.reserved[channel]++
+			return
+		}
+		if !blocked {
+			blocked = true
+			globals.PostQueueBlocked.Inc()
+			logrus.Debugf("Waiting to post to channel %s: queue full", channel)
+		}
+		pq.space.Wait()
+	}
+}
+
+// Close stops accepting messages and waits for all workers to drain
+func (pq *PostQueue) Close() {
+	pq.lock.Lock()
+	pq.closed = true
+	for _, w := range pq.workers {
+		w.signal()
+	}
+	pq.space.Broadcast()
+	pq.lock.Unlock()
+
+	pq.wg.Wait()
+}
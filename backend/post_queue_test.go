@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/venkytv/botmand/globals"
+	"github.com/venkytv/botmand/message"
+)
+
+func TestPostQueue(t *testing.T) {
+	posted := make(chan *message.Message, 10)
+	slow := make(chan bool)
+	pq := NewPostQueue(1, func(m *message.Message) {
+		if m.ChannelId == "CSLOW" {
+			<-slow
+		}
+		posted <- m
+	})
+
+	// Enqueueing doesn't block, even once a channel's queue is full
+	enqueued := make(chan bool)
+	go func() {
+		for _, text := range []string{"slow1", "slow2", "slow3"} {
+			pq.Enqueue(&message.Message{Text: text, ChannelId: "CSLOW"})
+		}
+		pq.Enqueue(&message.Message{Text: "fast", ChannelId: "CFAST"})
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(500 * time.Millisecond):
+		assert.FailNow(t, "Enqueue blocked by full queue")
+	}
+	select {
+	case m := <-posted:
+		assert.Equal(t, "fast", m.Text)
+	case <-time.After(500 * time.Millisecond):
+		assert.FailNow(t, "Post to fast channel blocked by slow channel")
+	}
+
+	// Posters to the slow channel wait until it catches up, but posters to
+	// other channels don't
+	blocked := testutil.ToFloat64(globals.PostQueueBlocked)
+	pq.Wait("CFAST")
+	assert.Equal(t, blocked, testutil.ToFloat64(globals.PostQueueBlocked))
+	waited := make(chan bool)
+	go func() {
+		pq.Wait("CSLOW")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		assert.FailNow(t, "Wait returned while queue full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(slow)
+	<-waited
+	assert.Equal(t, blocked+1, testutil.ToFloat64(globals.PostQueueBlocked))
+	for _, want := range []string{"slow1", "slow2", "slow3"} {
+		select {
+		case m := <-posted:
+			assert.Equal(t, want, m.Text)
+		case <-time.After(500 * time.Millisecond):
+			assert.FailNow(t, "Post to slow channel never completed")
+		}
+	}
+
+	pq.Close()
+}
+
+func TestPostQueueIdle(t *testing.T) {
+	posted := make(chan *message.Message, 10)
+	pq := NewPostQueue(1, func(m *message.Message) { posted <- m })
+	pq.idle = 10 * time.Millisecond
+
+	numWorkers := func() int {
+		pq.lock.Lock()
+		defer pq.lock.Unlock()
+		return len(pq.workers)
+	}
+
+	pq.Enqueue(&message.Message{Text: "hello", ChannelId: "C234567"})
+	<-posted
+	assert.Eventually(t, func() bool { return numWorkers() == 0 }, time.Second, 5*time.Millisecond)
+
+	// Channels get a new worker once they are posted to again
+	pq.Enqueue(&message.Message{Text: "again", ChannelId: "C234567"})
+	assert.Equal(t, "again", (<-posted).Text)
+
+	pq.Close()
+	assert.Equal(t, 0, numWorkers())
+}
+
+func TestPostQueueReserve(t *testing.T) {
+	posted := make(chan *message.Message, 10)
+	slow := make(chan bool)
+	pq := NewPostQueue(2, func(m *message.Message) {
+		<-slow
+		posted <- m
+	})
+
+	// Hold up the channel's worker posting a message
+	pq.Enqueue(&message.Message{Text: "zero", ChannelId: "C234567"})
+	assert.Eventually(t, func() bool {
+		pq.lock.Lock()
+		defer pq.lock.Unlock()
+		return len(pq.workers["C234567"].pending) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// Waiting reserves space, so that concurrent posters can't fill the
+	// queue past its size before their messages are enqueued
+	pq.Wait("C234567")
+	pq.Wait("C234567")
+	waited := make(chan bool)
+	go func() {
+		pq.Wait("C234567")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		assert.FailNow(t, "Wait returned with all space reserved")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pq.Enqueue(&message.Message{Text: "one", ChannelId: "C234567"})
+	pq.Enqueue(&message.Message{Text: "two", ChannelId: "C234567"})
+	select {
+	case <-waited:
+		assert.FailNow(t, "Wait returned while queue full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The third poster gets space once the next message is taken off the
+	// queue
+	slow <- true
+	assert.Equal(t, "zero", (<-posted).Text)
+	<-waited
+	pq.Enqueue(&message.Message{Text: "three", ChannelId: "C234567"})
+
+	close(slow)
+	for _, want := range []string{"one", "two", "three"} {
+		assert.Equal(t, want, (<-posted).Text)
+	}
+
+	pq.Close()
+}
@@ -1,7 +1,10 @@
 package backend
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"regexp"
@@ -14,11 +17,37 @@ import (
 	"github.com/venkytv/botmand/message"
 )
 
+// Slack truncates messages longer than this
+const slackMaxMessageLength = 40000
+
+// Maximum number of blocks in a Slack message
+const slackMaxBlocks = 50
+
+// Rich message payload posted by bots: either an array of blocks, or an
+// object with blocks, attachments, and fallback text
+type slackRichMessage struct {
+	Text        string             `json:"text"`
+	Blocks      slack.Blocks       `json:"blocks"`
+	Attachments []slack.Attachment `json:"attachments"`
+}
+
 type SlackApier interface {
 	ChannelInfo(channel string) *slack.Channel
 	GetEvents() chan slack.RTMEvent
 	PostMessage(channel string, msgOptions ...slack.MsgOption) (string, error)
 	PostTypingIndicator(channel string)
+	UploadFile(params slack.UploadFileV2Parameters) error
+	GetFile(url string, w io.Writer) error
+	AddReaction(name string, item slack.ItemRef) error
+	UpdateMessage(channel string, timestamp string, msgOptions ...slack.MsgOption) error
+	DeleteMessage(channel string, timestamp string) error
+	PostWebhook(url string, msg *slack.WebhookMessage) error
+	PostEphemeral(channel string, user string, msgOptions ...slack.MsgOption) error
+	OpenIM(user string) (string, error)
+	UserInfo(user string) (*slack.User, error)
+	Users() ([]slack.User, error)
+	UserGroups() ([]slack.UserGroup, error)
+	Channels() ([]slack.Channel, error)
 }
 
 // SlackApi implements the SlackApier interface
@@ -29,7 +58,10 @@ type SlackApi struct {
 
 func (s SlackApi) ChannelInfo(channel string) *slack.Channel {
 	logrus.Debug("Looking up channel info for ", channel)
-	ci, err := s.client.GetConversationInfo(channel, true)
+	ci, err := s.client.GetConversationInfo(&slack.GetConversationInfoInput{
+		ChannelID:     channel,
+		IncludeLocale: true,
+	})
 	if err != nil {
 		logrus.Error("Error looking up channel info: ", channel, err)
 		return &slack.Channel{}
@@ -51,6 +83,82 @@ func (s SlackApi) PostTypingIndicator(channel string) {
 	s.rtm.SendMessage(s.rtm.NewTypingMessage(channel))
 }
 
+// Upload a file through files.getUploadURLExternal and
+// files.completeUploadExternal, which replace files.upload
+func (s SlackApi) UploadFile(params slack.UploadFileV2Parameters) error {
+	_, err := s.client.UploadFileV2(params)
+	return err
+}
+
+func (s SlackApi) GetFile(url string, w io.Writer) error {
+	return s.client.GetFile(url, w)
+}
+
+func (s SlackApi) AddReaction(name string, item slack.ItemRef) error {
+	return s.client.AddReaction(name, item)
+}
+
+func (s SlackApi) UpdateMessage(channel string, timestamp string, msgOptions ...slack.MsgOption) error {
+	_, _, _, err := s.client.UpdateMessage(channel, timestamp, msgOptions...)
+	return err
+}
+
+func (s SlackApi) DeleteMessage(channel string, timestamp string) error {
+	_, _, err := s.client.DeleteMessage(channel, timestamp)
+	return err
+}
+
+func (s SlackApi) PostWebhook(url string, msg *slack.WebhookMessage) error {
+	return slack.PostWebhook(url, msg)
+}
+
+func (s SlackApi) PostEphemeral(channel string, user string, msgOptions ...slack.MsgOption) error {
+	_, err := s.client.PostEphemeral(channel, user, msgOptions...)
+	return err
+}
+
+func (s SlackApi) OpenIM(user string) (string, error) {
+	ch, _, _, err := s.client.OpenConversation(&slack.OpenConversationParameters{
+		Users: []string{user},
+	})
+	if err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
+
+func (s SlackApi) UserInfo(user string) (*slack.User, error) {
+	return s.client.GetUserInfo(user)
+}
+
+func (s SlackApi) Users() ([]slack.User, error) {
+	return s.client.GetUsers()
+}
+
+func (s SlackApi) UserGroups() ([]slack.UserGroup, error) {
+	return s.client.GetUserGroups(slack.GetUserGroupsOptionIncludeUsers(true))
+}
+
+func (s SlackApi) Channels() ([]slack.Channel, error) {
+	params := &slack.GetConversationsParameters{
+		ExcludeArchived: true,
+		Limit:           1000,
+		Types:           []string{"public_channel", "private_channel"},
+	}
+	var channels []slack.Channel
+	for {
+		page, cursor, err := s.client.GetConversations(params)
+		if err != nil {
+			return channels, err
+		}
+		channels = append(channels, page...)
+		if cursor == "" {
+			return channels, nil
+		}
+		params.Cursor = cursor
+	}
+}
+
 func NewSlackApi(token string, debug bool) SlackApi {
 	client := slack.New(
 		token,
@@ -72,32 +180,62 @@ type SlackBackend struct {
 	botId       string
 	botName     string
 	atMePattern *regexp.Regexp
-	chanCache   map[string]*slack.Channel
-	sanitiser   func(*message.Message) *message.Message
+	chanCache   *channelCache
+	users       *userCache
+	directory   *slackDirectory
 	msgCache    *bigcache.BigCache
+	postQueue   *PostQueue
 }
 
 func NewSlackBackend(api SlackApier, comm *BackendQueues) *SlackBackend {
-	msgCache, err := bigcache.NewBigCache(bigcache.DefaultConfig(1 * time.Minute))
+	// The cache only holds the timestamps of events seen, so needs far less
+	// space up front than the default
+	cacheConfig := bigcache.DefaultConfig(1 * time.Minute)
+	cacheConfig.MaxEntriesInWindow = 10000
+	cacheConfig.MaxEntrySize = 64
+	msgCache, err := bigcache.NewBigCache(cacheConfig)
 	if err != nil {
 		logrus.Fatal("Failed to initialise message cache: ", err)
 	}
 
-	return &SlackBackend{
+	s := &SlackBackend{
 		api:  api,
 		comm: comm,
 
 		atMePattern: regexp.MustCompile(`^$`),
-		chanCache:   make(map[string]*slack.Channel),
-		sanitiser:   func(m *message.Message) *message.Message { return m },
+		chanCache:   newChannelCache(api.ChannelInfo, chanCacheTTL),
+		users:       newUserCache(api.UserInfo, userCacheTTL),
+		directory:   newSlackDirectory(api, directoryTTL),
 		msgCache:    msgCache,
 	}
+	s.postQueue = NewPostQueue(cap(comm.RespQ), s.post)
+
+	return s
 }
 
 func (s SlackBackend) Name() string {
 	return "Slack"
 }
 
+func channelType(cc *slack.Channel) string {
+	switch {
+	case cc.IsIM:
+		return message.ChannelTypeIM
+	case cc.IsMpIM:
+		return message.ChannelTypeMpIM
+	case cc.IsGroup || cc.IsPrivate:
+		return message.ChannelTypeGroup
+	}
+	return message.ChannelTypeChannel
+}
+
+// Check if a message is addressed to the bot. Every message in a direct
+// message channel is.
+func (s SlackBackend) isDirectMessage(chanType string, text string) bool {
+	return chanType == message.ChannelTypeIM || chanType == message.ChannelTypeMpIM ||
+		s.atMePattern.MatchString(text)
+}
+
 func (s SlackBackend) newMessage(ev *slack.MessageEvent, cc *slack.Channel) *message.Message {
 	thread := ev.ThreadTimestamp
 	inThread := true // Assume we're in a thread unless we're not
@@ -107,6 +245,18 @@ func (s SlackBackend) newMessage(ev *slack.MessageEvent, cc *slack.Channel) *mes
 		thread = ev.Timestamp
 	}
 
+	files := []message.File{}
+	for _, f := range ev.Files {
+		files = append(files, message.File{
+			Name:     f.Name,
+			Mimetype: f.Mimetype,
+			Size:     int64(f.Size),
+			URL:      f.URLPrivateDownload,
+		})
+	}
+
+	chanType := channelType(cc)
+
 	return &message.Message{
 		Text:          ev.Text,
 		User:          ev.User,
@@ -114,19 +264,94 @@ func (s SlackBackend) newMessage(ev *slack.MessageEvent, cc *slack.Channel) *mes
 		BotUserName:   s.botName,
 		ChannelId:     ev.Channel,
 		ChannelName:   cc.Name,
+		ChannelType:   chanType,
 		ThreadId:      thread,
 		InThread:      inThread,
-		DirectMessage: s.atMePattern.MatchString(ev.Text),
+		DirectMessage: s.isDirectMessage(chanType, ev.Text),
 		Locale:        cc.Locale,
+		Files:         files,
+		Timestamp:     ev.Timestamp,
 	}
 }
 
-func (s SlackBackend) channelInfo(channel string) *slack.Channel {
-	if _, exists := s.chanCache[channel]; !exists {
-		s.chanCache[channel] = s.api.ChannelInfo(channel)
+// Build a message for an edit or deletion of an earlier message. The
+// timestamp is that of the original message.
+func (s SlackBackend) newChangeMessage(ev *slack.MessageEvent) *message.Message {
+	var orig *slack.Msg
+	event := message.EventMessageChanged
+	switch ev.SubType {
+	case "message_changed":
+		orig = ev.SubMessage
+		if orig != nil && orig.Edited == nil {
+			// Not an edit; e.g., a reply added to a thread
+			return nil
+		}
+	case "message_deleted":
+		orig = ev.PreviousMessage
+		event = message.EventMessageDeleted
+	}
+	if orig == nil || orig.User == "" || orig.User == s.botId {
+		return nil
+	}
+
+	cc := s.channelInfo(ev.Channel)
+	chanType := channelType(cc)
+	m := &message.Message{
+		Text:          orig.Text,
+		User:          orig.User,
+		BotUserId:     s.botId,
+		BotUserName:   s.botName,
+		ChannelId:     ev.Channel,
+		ChannelName:   cc.Name,
+		ChannelType:   chanType,
+		ThreadId:      orig.ThreadTimestamp,
+		InThread:      orig.ThreadTimestamp != "",
+		DirectMessage: s.isDirectMessage(chanType, orig.Text),
+		Locale:        cc.Locale,
+		Timestamp:     orig.Timestamp,
+		Event:         event,
+	}
+	if event == message.EventMessageDeleted {
+		m.Timestamp = ev.DeletedTimestamp
 	}
 
-	return s.chanCache[channel]
+	return m
+}
+
+func (s SlackBackend) newReactionMessage(event int, user string, reaction string, channel string, timestamp string) *message.Message {
+	cc := s.channelInfo(channel)
+
+	return &message.Message{
+		User:        user,
+		BotUserId:   s.botId,
+		BotUserName: s.botName,
+		ChannelId:   channel,
+		ChannelName: cc.Name,
+		ChannelType: channelType(cc),
+		Locale:      cc.Locale,
+		Timestamp:   timestamp,
+		Event:       event,
+		Reaction:    reaction,
+	}
+}
+
+func (s SlackBackend) newJoinMessage(channel string) *message.Message {
+	// Membership changes what can be looked up about the channel
+	s.chanCache.invalidate(channel)
+	cc := s.channelInfo(channel)
+
+	return &message.Message{
+		BotUserId:   s.botId,
+		BotUserName: s.botName,
+		ChannelId:   channel,
+		ChannelName: cc.Name,
+		ChannelType: channelType(cc),
+		Event:       message.EventChannelJoined,
+	}
+}
+
+func (s SlackBackend) channelInfo(channel string) *slack.Channel {
+	return s.chanCache.get(channel)
 }
 
 func (s *SlackBackend) Read() {
@@ -147,6 +372,14 @@ func (s *SlackBackend) Read() {
 				break
 			}
 
+			if ev.SubType == "message_changed" || ev.SubType == "message_deleted" {
+				if m := s.newChangeMessage(ev); m != nil {
+					logrus.Debugf("Message %s: %#v", ev.SubType, m)
+					s.comm.MesgQ <- m
+				}
+				break
+			}
+
 			if ev.User == "" {
 				logrus.Debugf("Ignoring ghost message: %#v", ev)
 				break
@@ -184,6 +417,49 @@ func (s *SlackBackend) Read() {
 
 			s.comm.MesgQ <- m
 
+		case *slack.ReactionAddedEvent:
+			if s.botId == "" || ev.User == s.botId || ev.Item.Type != "message" {
+				break
+			}
+			s.comm.MesgQ <- s.newReactionMessage(message.EventReactionAdded, ev.User, ev.Reaction, ev.Item.Channel, ev.Item.Timestamp)
+
+		case *slack.ReactionRemovedEvent:
+			if s.botId == "" || ev.User == s.botId || ev.Item.Type != "message" {
+				break
+			}
+			s.comm.MesgQ <- s.newReactionMessage(message.EventReactionRemoved, ev.User, ev.Reaction, ev.Item.Channel, ev.Item.Timestamp)
+
+		case *slack.ChannelJoinedEvent:
+			if s.botId == "" {
+				break
+			}
+			logrus.Infof("Joined channel %s", ev.Channel.ID)
+			s.comm.MesgQ <- s.newJoinMessage(ev.Channel.ID)
+
+		case *slack.GroupJoinedEvent:
+			if s.botId == "" {
+				break
+			}
+			logrus.Infof("Joined channel %s", ev.Channel.ID)
+			s.comm.MesgQ <- s.newJoinMessage(ev.Channel.ID)
+
+		case *slack.ChannelRenameEvent:
+			logrus.Debugf("Channel %s renamed to %s", ev.Channel.ID, ev.Channel.Name)
+			s.chanCache.invalidate(ev.Channel.ID)
+
+		case *slack.GroupRenameEvent:
+			logrus.Debugf("Channel %s renamed to %s", ev.Group.ID, ev.Group.Name)
+			s.chanCache.invalidate(ev.Group.ID)
+
+		case *slack.ChannelArchiveEvent:
+			s.chanCache.invalidate(ev.Channel)
+
+		case *slack.GroupArchiveEvent:
+			s.chanCache.invalidate(ev.Channel)
+
+		case *slack.MemberJoinedChannelEvent:
+			s.chanCache.invalidate(ev.Channel)
+
 		case *slack.RTMError:
 			logrus.Errorf("RTM error: %s", ev.Error())
 
@@ -203,38 +479,267 @@ func (s SlackBackend) Post() {
 		msg, more := <-s.comm.RespQ
 		if !more {
 			logrus.Debug("Shutting down SlackBackend")
+			s.postQueue.Close()
 			return
 		}
 		logrus.Debugf("Got response: %#v", msg)
 
-		if msg.Text == "..." {
-			// Send a typing indicator
-			s.api.PostTypingIndicator(msg.ChannelId)
-			continue
+		s.postQueue.Enqueue(msg)
+	}
+}
+
+func (s SlackBackend) post(msg *message.Message) {
+	if msg.Text == "..." {
+		// Send a typing indicator
+		s.api.PostTypingIndicator(msg.ChannelId)
+		if msg.NeedThreadId {
+			// Typing indicators can't start threads
+			msg.ThreadIdChan <- ""
 		}
+		return
+	}
 
-		// Convert embedded \n to actual newlines
+	// Convert embedded \n to actual newlines
+	if msg.ExpandNewlines {
 		msg.Text = strings.ReplaceAll(msg.Text, `\n`, "\n")
+	}
+
+	if msg.ExpandMentions {
+		msg.Text = s.expandMentions(msg.Text)
+	}
+
+	target := msg.Timestamp
+	if msg.Target != nil {
+		target = msg.Target()
+	}
 
+	switch msg.Action {
+	case message.ActionOpenIM:
+		channel, err := s.api.OpenIM(msg.User)
+		if err != nil {
+			logrus.Errorf("OpenIM error: %s: %v", msg.User, err)
+		}
+		msg.ChannelIdChan <- channel
+		return
+
+	case message.ActionUpload:
+		s.upload(msg)
+		return
+
+	case message.ActionReact:
+		err := s.api.AddReaction(msg.Reaction, slack.NewRefToMessage(msg.ChannelId, target))
+		if err != nil {
+			logrus.Errorf("AddReaction error: %s: %v", msg.Reaction, err)
+		}
+		return
+
+	case message.ActionUpdate:
+		if target != "" {
+			err := s.api.UpdateMessage(msg.ChannelId, target, slack.MsgOptionText(msg.Text, false))
+			if err != nil {
+				logrus.Errorf("UpdateMessage error: %s: %v", target, err)
+			}
+			if msg.NeedThreadId {
+				// Edits can't start threads
+				msg.ThreadIdChan <- ""
+			}
+			return
+		}
+		// Nothing to update yet, so post a new message instead
+
+	case message.ActionDelete:
+		if target == "" {
+			logrus.Warnf("No message to delete in channel %s", msg.ChannelId)
+			return
+		}
+		if err := s.api.DeleteMessage(msg.ChannelId, target); err != nil {
+			logrus.Errorf("DeleteMessage error: %s: %v", target, err)
+		} else if msg.Deleted != nil {
+			msg.Deleted(target)
+		}
+		return
+	}
+
+	var rich *slackRichMessage
+	var richOptions []slack.MsgOption
+	if len(msg.Blocks) > 0 {
+		var err error
+		if rich, err = parseRichMessage(msg.Blocks); err != nil {
+			logrus.Warnf("Invalid rich message, posting as text: %v", err)
+		} else {
+			msg.Text = rich.Text
+			richOptions = []slack.MsgOption{
+				slack.MsgOptionBlocks(rich.Blocks.BlockSet...),
+				slack.MsgOptionAttachments(rich.Attachments...),
+			}
+		}
+	}
+
+	if msg.ResponseURL != "" {
+		// Respond visibly only to the user who prompted the message
+		webhookMsg := &slack.WebhookMessage{
+			Text:         msg.Text,
+			ResponseType: slack.ResponseTypeEphemeral,
+		}
+		if rich != nil {
+			webhookMsg.Blocks = &rich.Blocks
+			webhookMsg.Attachments = rich.Attachments
+		}
+		if err := s.api.PostWebhook(msg.ResponseURL, webhookMsg); err != nil {
+			logrus.Error("PostWebhook error: ", err)
+		}
+		if msg.NeedThreadId {
+			// Responses can't start threads
+			msg.ThreadIdChan <- ""
+		}
+		return
+	}
+
+	if msg.Action == message.ActionEphemeral {
+		// Post the message visible only to one user
 		msgOptions := []slack.MsgOption{
 			slack.MsgOptionText(msg.Text, false),
 			slack.MsgOptionAsUser(true),
 			slack.MsgOptionTS(msg.ThreadId),
 		}
+		msgOptions = append(msgOptions, richOptions...)
+		if err := s.api.PostEphemeral(msg.ChannelId, msg.User, msgOptions...); err != nil {
+			logrus.Errorf("PostEphemeral error: %s: %v", msg.User, err)
+		}
+		if msg.NeedThreadId {
+			// Ephemeral messages can't start threads
+			msg.ThreadIdChan <- ""
+		}
+		return
+	}
+
+	// Split messages too long for Slack, and return the timestamp of the
+	// first part if a thread ID is needed
+	var timestamp string
+	for i, text := range splitText(msg.Text, slackMaxMessageLength) {
+		msgOptions := []slack.MsgOption{
+			slack.MsgOptionText(text, false),
+			slack.MsgOptionAsUser(true),
+			slack.MsgOptionTS(msg.ThreadId),
+		}
+		msgOptions = append(msgOptions, richOptions...)
 
-		timestamp, err := s.api.PostMessage(msg.ChannelId, msgOptions...)
+		ts, err := s.api.PostMessage(msg.ChannelId, msgOptions...)
 		if err != nil {
 			logrus.Error("PostMessage error: ", err)
+		} else if msg.Posted != nil {
+			msg.Posted(ts)
+		}
+		if i == 0 {
+			timestamp = ts
 		}
+	}
 
-		if msg.NeedThreadId {
-			logrus.Debugf("Returning thread ID %s on channel", timestamp)
-			msg.ThreadIdChan <- timestamp
+	if msg.NeedThreadId {
+		logrus.Debugf("Returning thread ID %s on channel", timestamp)
+		msg.ThreadIdChan <- timestamp
+	}
+}
+
+func (s SlackBackend) upload(msg *message.Message) {
+	u := msg.Upload
+	// Slack works out the type of the file from its name
+	params := slack.UploadFileV2Parameters{
+		Filename:        u.Filename,
+		Title:           u.Title,
+		InitialComment:  msg.Text,
+		Channel:         msg.ChannelId,
+		ThreadTimestamp: msg.ThreadId,
+	}
+
+	if u.Path != "" {
+		f, err := os.Open(u.Path)
+		if err != nil {
+			logrus.Errorf("Failed to open file for upload: %s: %v", u.Path, err)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			logrus.Errorf("Failed to open file for upload: %s: %v", u.Path, err)
+			return
+		}
+		params.Reader = f
+		params.FileSize = int(fi.Size())
+	} else {
+		params.Reader = bytes.NewReader(u.Content)
+		params.FileSize = len(u.Content)
+	}
+
+	if err := s.api.UploadFile(params); err != nil {
+		logrus.Errorf("UploadFile error: %s: %v", u.Filename, err)
+	}
+
+	if u.Path != "" && u.Remove {
+		if err := os.Remove(u.Path); err != nil {
+			logrus.Warnf("Failed to remove uploaded file: %s: %v", u.Path, err)
 		}
 	}
 }
 
-func (s SlackBackend) Sanitize(m *message.Message) *message.Message {
-	// Do nothing
-	return m
+func parseRichMessage(payload []byte) (*slackRichMessage, error) {
+	rich := &slackRichMessage{}
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		if err := json.Unmarshal(payload, &rich.Blocks); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(payload, rich); err != nil {
+		return nil, err
+	}
+
+	if len(rich.Blocks.BlockSet) == 0 && len(rich.Attachments) == 0 {
+		return nil, fmt.Errorf("no blocks or attachments in message")
+	}
+	if len(rich.Blocks.BlockSet) > slackMaxBlocks {
+		return nil, fmt.Errorf("too many blocks: %d (limit %d)", len(rich.Blocks.BlockSet), slackMaxBlocks)
+	}
+	for _, block := range rich.Blocks.BlockSet {
+		if _, unknown := block.(*slack.UnknownBlock); unknown {
+			return nil, fmt.Errorf("unknown block type: %s", block.BlockType())
+		}
+	}
+
+	return rich, nil
+}
+
+// Split text into chunks of at most max characters, breaking at the last
+// newline in each chunk where possible
+func splitText(text string, max int) []string {
+	chunks := []string{}
+	runes := []rune(text)
+	for len(runes) > max {
+		n := max
+		for i := max; i > 0; i-- {
+			if runes[i-1] == '\n' {
+				n = i
+				break
+			}
+		}
+		chunks = append(chunks, strings.TrimRight(string(runes[:n]), "\n"))
+		runes = runes[n:]
+	}
+	return append(chunks, string(runes))
+}
+
+func (s SlackBackend) DownloadFile(url string, w io.Writer) error {
+	return s.api.GetFile(url, w)
+}
+
+func (s SlackBackend) InUserGroup(user string, group string) bool {
+	return s.directory.inGroup(user, group)
+}
+
+func (s SlackBackend) LookupChannel(channelId string) (string, string) {
+	cc := s.channelInfo(channelId)
+	return cc.Name, channelType(cc)
+}
+
+func (s SlackBackend) WaitToPost(channelId string) {
+	s.postQueue.Wait(channelId)
 }
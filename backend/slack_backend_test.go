@@ -1,9 +1,19 @@
 package backend
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +27,10 @@ const (
 	TestEventConnect int = iota
 	TestEventChannelJoined
 	TestEventMessage
+	TestEventReactionAdded
+	TestEventMessageChanged
+	TestEventMessageDeleted
+	TestEventChannelRename
 	TestEventDisconnect
 )
 
@@ -29,15 +43,54 @@ type TestSlackEvent struct {
 	Message     string
 	Thread      string
 	Timestamp   string
+	Files       []slack.File
+	Reaction    string
+}
+
+type TestSlackPost struct {
+	ChannelId string
+	Options   []slack.MsgOption
 }
 
 type TestSlackApi struct {
 	ChannelMap   map[string]string
+	IMChannels   map[string]bool
+	UserMap      map[string]*slack.User
+	Groups       []slack.UserGroup
+	ChannelList  []slack.Channel
 	Events       []TestSlackEvent
 	ExpectedMsgs []*message.Message
+
+	// Posted messages are sent here if set
+	Posts chan TestSlackPost
+
+	// Posts to these channels block until the channel is closed
+	Blockers map[string]chan bool
+
+	// Uploaded files are sent here if set
+	Uploads chan slack.UploadFileV2Parameters
+
+	// Reactions added are sent here if set
+	Reactions chan string
+
+	// Updated and deleted message timestamps are sent here if set
+	Updates chan string
+	Deletes chan string
+
+	// Messages posted to response URLs are sent here if set
+	Webhooks chan *slack.WebhookMessage
+
+	// Users ephemeral messages are posted to are sent here if set
+	Ephemerals chan string
 }
 
 func (s TestSlackApi) ChannelInfo(channel string) *slack.Channel {
+	if s.IMChannels[channel] {
+		ci := &slack.Channel{}
+		ci.IsIM = true
+		return ci
+	}
+
 	ci, exists := s.ChannelMap[channel]
 	if !exists {
 		return &slack.Channel{}
@@ -89,6 +142,7 @@ func (s TestSlackApi) genRTMEvent(tse TestSlackEvent) slack.RTMEvent {
 				Channel: tse.ChannelId,
 				SubType: tse.SubType,
 				Text:    tse.Message,
+				Files:   tse.Files,
 			},
 		}
 		if tse.Thread != "" {
@@ -103,6 +157,57 @@ func (s TestSlackApi) genRTMEvent(tse TestSlackEvent) slack.RTMEvent {
 
 		return slack.RTMEvent{Data: &ev}
 
+	case TestEventReactionAdded:
+		ev := slack.ReactionAddedEvent{
+			User:     tse.From,
+			Reaction: tse.Reaction,
+		}
+		ev.Item.Type = "message"
+		ev.Item.Channel = tse.ChannelId
+		ev.Item.Timestamp = tse.Timestamp
+		return slack.RTMEvent{Data: &ev}
+
+	case TestEventMessageChanged:
+		ev := slack.MessageEvent{
+			Msg: slack.Msg{
+				Channel: tse.ChannelId,
+				SubType: "message_changed",
+			},
+			SubMessage: &slack.Msg{
+				User:            tse.From,
+				Text:            tse.Message,
+				Timestamp:       tse.Timestamp,
+				ThreadTimestamp: tse.Thread,
+				Edited:          &slack.Edited{User: tse.From},
+			},
+		}
+		return slack.RTMEvent{Data: &ev}
+
+	case TestEventMessageDeleted:
+		ev := slack.MessageEvent{
+			Msg: slack.Msg{
+				Channel:          tse.ChannelId,
+				SubType:          "message_deleted",
+				DeletedTimestamp: tse.Timestamp,
+			},
+			PreviousMessage: &slack.Msg{
+				User:            tse.From,
+				Text:            tse.Message,
+				Timestamp:       tse.Timestamp,
+				ThreadTimestamp: tse.Thread,
+			},
+		}
+		return slack.RTMEvent{Data: &ev}
+
+	case TestEventChannelRename:
+		ev := slack.ChannelRenameEvent{
+			Channel: slack.ChannelRenameInfo{
+				ID:   tse.ChannelId,
+				Name: tse.Message,
+			},
+		}
+		return slack.RTMEvent{Data: &ev}
+
 	case TestEventDisconnect:
 		ev := slack.DisconnectedEvent{Intentional: true}
 		return slack.RTMEvent{Data: &ev}
@@ -127,11 +232,105 @@ func (s TestSlackApi) GetEvents() chan slack.RTMEvent {
 }
 
 func (s TestSlackApi) PostMessage(channel string, msgOptions ...slack.MsgOption) (string, error) {
+	if blocker, exists := s.Blockers[channel]; exists {
+		<-blocker
+	}
+	if s.Posts != nil {
+		s.Posts <- TestSlackPost{ChannelId: channel, Options: msgOptions}
+	}
 	return "", nil
 }
 
 func (s TestSlackApi) PostTypingIndicator(channel string) {}
 
+func (s TestSlackApi) GetFile(url string, w io.Writer) error {
+	_, err := io.WriteString(w, url)
+	return err
+}
+
+func (s TestSlackApi) AddReaction(name string, item slack.ItemRef) error {
+	if s.Reactions != nil {
+		s.Reactions <- fmt.Sprintf("%s %s %s", name, item.Channel, item.Timestamp)
+	}
+	return nil
+}
+
+func (s TestSlackApi) UpdateMessage(channel string, timestamp string, msgOptions ...slack.MsgOption) error {
+	if s.Updates != nil {
+		s.Updates <- timestamp
+	}
+	return nil
+}
+
+func (s TestSlackApi) DeleteMessage(channel string, timestamp string) error {
+	if s.Deletes != nil {
+		s.Deletes <- timestamp
+	}
+	return nil
+}
+
+func (s TestSlackApi) PostWebhook(url string, msg *slack.WebhookMessage) error {
+	if s.Webhooks != nil {
+		s.Webhooks <- msg
+	}
+	return nil
+}
+
+func (s TestSlackApi) PostEphemeral(channel string, user string, msgOptions ...slack.MsgOption) error {
+	if s.Ephemerals != nil {
+		s.Ephemerals <- user
+	}
+	return nil
+}
+
+func (s TestSlackApi) OpenIM(user string) (string, error) {
+	return "D" + user, nil
+}
+
+func (s TestSlackApi) UserInfo(user string) (*slack.User, error) {
+	u, exists := s.UserMap[user]
+	if !exists {
+		return nil, errors.New("user_not_found")
+	}
+	return u, nil
+}
+
+func (s TestSlackApi) Users() ([]slack.User, error) {
+	users := []slack.User{}
+	for id, u := range s.UserMap {
+		user := *u
+		user.ID = id
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s TestSlackApi) UserGroups() ([]slack.UserGroup, error) {
+	return s.Groups, nil
+}
+
+func (s TestSlackApi) Channels() ([]slack.Channel, error) {
+	return s.ChannelList, nil
+}
+
+func (s TestSlackApi) UploadFile(params slack.UploadFileV2Parameters) error {
+	if s.Uploads != nil {
+		s.Uploads <- params
+	}
+	return nil
+}
+
+// Create a backend whose message cache and post workers are stopped when the
+// test ends
+func newTestSlackBackend(t *testing.T, api SlackApier, comm *BackendQueues) *SlackBackend {
+	s := NewSlackBackend(api, comm)
+	t.Cleanup(func() {
+		s.postQueue.Close()
+		s.msgCache.Close()
+	})
+	return s
+}
+
 func TestRead(t *testing.T) {
 	var botUserId = "IAMALITTLESLACKBOT"
 	//var myMsgTimestamp = "3344556.77889"
@@ -140,6 +339,9 @@ func TestRead(t *testing.T) {
 		ChannelMap: map[string]string{
 			"C234567": "TestChannel1",
 		},
+		IMChannels: map[string]bool{
+			"D234567": true,
+		},
 		Events: []TestSlackEvent{
 			TestSlackEvent{
 				// This message sets up the bot User ID
@@ -159,6 +361,70 @@ func TestRead(t *testing.T) {
 				From:      "U234567",
 				ChannelId: "C234567",
 			},
+			TestSlackEvent{
+				Type:      TestEventMessage,
+				Message:   "TestIMMessage",
+				From:      "U234567",
+				ChannelId: "D234567",
+			},
+			TestSlackEvent{
+				Type:      TestEventMessage,
+				SubType:   "file_share",
+				Message:   "TestFileMessage",
+				From:      "U234567",
+				ChannelId: "C234567",
+				Files: []slack.File{
+					{
+						Name:               "app.log",
+						Mimetype:           "text/plain",
+						Size:               1234,
+						URLPrivateDownload: "https://files.example.com/app.log",
+					},
+				},
+			},
+			TestSlackEvent{
+				// Reactions by the bot itself should be dropped
+				Type:      TestEventReactionAdded,
+				Reaction:  "eyes",
+				From:      botUserId,
+				ChannelId: "C234567",
+				Timestamp: "1234.5678",
+			},
+			TestSlackEvent{
+				Type:      TestEventReactionAdded,
+				Reaction:  "white_check_mark",
+				From:      "U234567",
+				ChannelId: "C234567",
+				Timestamp: "1234.5678",
+			},
+			TestSlackEvent{
+				Type:      TestEventMessageChanged,
+				Message:   "TestEditedMessage",
+				From:      "U234567",
+				ChannelId: "C234567",
+				Thread:    "1234.0000",
+				Timestamp: "1234.5678",
+			},
+			TestSlackEvent{
+				Type:      TestEventMessageDeleted,
+				Message:   "TestDeletedMessage",
+				From:      "U234567",
+				ChannelId: "C234567",
+				Thread:    "1234.0000",
+				Timestamp: "1234.6789",
+			},
+			TestSlackEvent{
+				// Deletions of the bot's own messages should be dropped
+				Type:      TestEventMessageDeleted,
+				Message:   "BotMessage",
+				From:      botUserId,
+				ChannelId: "C234567",
+				Timestamp: "1234.7890",
+			},
+			TestSlackEvent{
+				Type:      TestEventChannelJoined,
+				ChannelId: "C234567",
+			},
 		},
 		ExpectedMsgs: []*message.Message{
 			&message.Message{
@@ -166,13 +432,66 @@ func TestRead(t *testing.T) {
 				User:        "U234567",
 				ChannelId:   "C234567",
 				ChannelName: "TestChannel1",
+				ChannelType: message.ChannelTypeChannel,
+			},
+			&message.Message{
+				Text:          "TestIMMessage",
+				User:          "U234567",
+				ChannelId:     "D234567",
+				ChannelType:   message.ChannelTypeIM,
+				DirectMessage: true,
+			},
+			&message.Message{
+				Text:        "TestFileMessage",
+				User:        "U234567",
+				ChannelId:   "C234567",
+				ChannelName: "TestChannel1",
+				Files: []message.File{
+					{
+						Name:     "app.log",
+						Mimetype: "text/plain",
+						Size:     1234,
+						URL:      "https://files.example.com/app.log",
+					},
+				},
+			},
+			&message.Message{
+				User:        "U234567",
+				ChannelId:   "C234567",
+				ChannelName: "TestChannel1",
+				Timestamp:   "1234.5678",
+				Event:       message.EventReactionAdded,
+				Reaction:    "white_check_mark",
+			},
+			&message.Message{
+				Text:        "TestEditedMessage",
+				User:        "U234567",
+				ChannelId:   "C234567",
+				ChannelName: "TestChannel1",
+				ThreadId:    "1234.0000",
+				Timestamp:   "1234.5678",
+				Event:       message.EventMessageChanged,
+			},
+			&message.Message{
+				Text:        "TestDeletedMessage",
+				User:        "U234567",
+				ChannelId:   "C234567",
+				ChannelName: "TestChannel1",
+				ThreadId:    "1234.0000",
+				Timestamp:   "1234.6789",
+				Event:       message.EventMessageDeleted,
+			},
+			&message.Message{
+				ChannelId:   "C234567",
+				ChannelName: "TestChannel1",
+				Event:       message.EventChannelJoined,
 			},
 		},
 	}
 
-	backendQs := NewBackendQueues()
+	backendQs := NewBackendQueues(DefaultQBufferSize)
 
-	backend := NewSlackBackend(&api, &backendQs)
+	backend := newTestSlackBackend(t, &api, &backendQs)
 	go backend.Read()
 
 	for _, m := range api.ExpectedMsgs {
@@ -186,6 +505,21 @@ func TestRead(t *testing.T) {
 					assert.Equal(t, m.ChannelName, got.ChannelName)
 				}
 
+				if len(m.Files) > 0 {
+					assert.Equal(t, m.Files, got.Files)
+				}
+
+				assert.Equal(t, m.Event, got.Event)
+				assert.Equal(t, m.DirectMessage, got.DirectMessage)
+				if m.ChannelType != "" {
+					assert.Equal(t, m.ChannelType, got.ChannelType)
+				}
+				if m.Event != message.EventMessage {
+					assert.Equal(t, m.Reaction, got.Reaction)
+					assert.Equal(t, m.Timestamp, got.Timestamp)
+					assert.Equal(t, m.ThreadId, got.ThreadId)
+				}
+
 			case <-time.After(500 * time.Millisecond):
 				assert.Failf(t, "Failed to read backend msg", "Was expecting: %#v", m)
 			}
@@ -207,6 +541,719 @@ func TestRead(t *testing.T) {
 	})
 }
 
+func TestPostPerChannel(t *testing.T) {
+	slowChannel := make(chan bool)
+	api := TestSlackApi{
+		Posts: make(chan TestSlackPost, 10),
+		Blockers: map[string]chan bool{
+			"CSLOW": slowChannel,
+		},
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+
+	backendQs.RespQ <- &message.Message{Text: "slow", ChannelId: "CSLOW"}
+	backendQs.RespQ <- &message.Message{Text: "fast1", ChannelId: "CFAST"}
+	backendQs.RespQ <- &message.Message{Text: "fast2", ChannelId: "CFAST"}
+
+	// Messages to other channels are not held up by the slow channel
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-api.Posts:
+			assert.Equal(t, "CFAST", got.ChannelId)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "Post to fast channel blocked by slow channel")
+		}
+	}
+
+	close(slowChannel)
+	select {
+	case got := <-api.Posts:
+		assert.Equal(t, "CSLOW", got.ChannelId)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "Post to slow channel never completed")
+	}
+
+	close(backendQs.RespQ)
+}
+
+func TestTypingIndicator(t *testing.T) {
+	api := TestSlackApi{
+		Posts: make(chan TestSlackPost, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	m := &message.Message{
+		Text:         "...",
+		ChannelId:    "C234567",
+		NeedThreadId: true,
+		ThreadIdChan: make(chan string, 1),
+	}
+	backendQs.RespQ <- m
+
+	// Typing indicators don't start threads
+	select {
+	case threadId := <-m.ThreadIdChan:
+		assert.Equal(t, "", threadId)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "No thread ID returned")
+	}
+	select {
+	case <-api.Posts:
+		assert.Fail(t, "Typing indicator posted as a message")
+	default:
+	}
+}
+
+func TestUpload(t *testing.T) {
+	api := TestSlackApi{
+		Uploads: make(chan slack.UploadFileV2Parameters, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{
+		Text:      "Here you go",
+		ChannelId: "C234567",
+		ThreadId:  "1234.5678",
+		Action:    message.ActionUpload,
+		Upload: &message.Upload{
+			Content:  []byte("a,b\n1,2\n"),
+			Filename: "report.csv",
+			Filetype: "csv",
+		},
+	}
+
+	select {
+	case got := <-api.Uploads:
+		assert.Equal(t, "report.csv", got.Filename)
+		assert.Equal(t, "Here you go", got.InitialComment)
+		assert.Equal(t, "C234567", got.Channel)
+		assert.Equal(t, "1234.5678", got.ThreadTimestamp)
+		assert.Equal(t, 8, got.FileSize)
+		content, err := ioutil.ReadAll(got.Reader)
+		assert.Nil(t, err)
+		assert.Equal(t, "a,b\n1,2\n", string(content))
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "File not uploaded")
+	}
+}
+
+func TestReact(t *testing.T) {
+	api := TestSlackApi{
+		Reactions: make(chan string, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{
+		ChannelId: "C234567",
+		Timestamp: "1234.5678",
+		Action:    message.ActionReact,
+		Reaction:  "rocket",
+	}
+
+	select {
+	case got := <-api.Reactions:
+		assert.Equal(t, "rocket C234567 1234.5678", got)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "Reaction not added")
+	}
+}
+
+func TestUpdateAndDelete(t *testing.T) {
+	api := TestSlackApi{
+		Posts:   make(chan TestSlackPost, 1),
+		Updates: make(chan string, 1),
+		Deletes: make(chan string, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	target := ""
+	deleted := make(chan string, 1)
+	newMsg := func(action int) *message.Message {
+		return &message.Message{
+			Text:      "Running tests... 3/10",
+			ChannelId: "C234567",
+			Action:    action,
+			Target:    func() string { return target },
+			Deleted:   func(ts string) { deleted <- ts },
+		}
+	}
+
+	t.Run("UpdateWithoutTarget", func(t *testing.T) {
+		// Nothing to update, so a new message is posted
+		backendQs.RespQ <- newMsg(message.ActionUpdate)
+		select {
+		case got := <-api.Posts:
+			assert.Equal(t, "C234567", got.ChannelId)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "Message not posted")
+		}
+	})
+
+	target = "1234.5678"
+
+	t.Run("Update", func(t *testing.T) {
+		m := newMsg(message.ActionUpdate)
+		m.NeedThreadId = true
+		m.ThreadIdChan = make(chan string, 1)
+		backendQs.RespQ <- m
+		select {
+		case got := <-api.Updates:
+			assert.Equal(t, target, got)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "Message not updated")
+		}
+
+		// Edits don't start threads
+		select {
+		case threadId := <-m.ThreadIdChan:
+			assert.Equal(t, "", threadId)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "No thread ID returned")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		backendQs.RespQ <- newMsg(message.ActionDelete)
+		select {
+		case got := <-api.Deletes:
+			assert.Equal(t, target, got)
+			assert.Equal(t, target, <-deleted)
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "Message not deleted")
+		}
+	})
+}
+
+func TestParseRichMessage(t *testing.T) {
+	rich, err := parseRichMessage([]byte(`[
+		{"type": "section", "text": {"type": "mrkdwn", "text": "*Deploy* done"}},
+		{"type": "context", "elements": [{"type": "mrkdwn", "text": "by deploybot"}]}
+	]`))
+	assert.Nil(t, err)
+	assert.Len(t, rich.Blocks.BlockSet, 2)
+
+	rich, err = parseRichMessage([]byte(`{
+		"text": "Build failed",
+		"attachments": [{"color": "#ff0000", "text": "3 tests failed"}]
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "Build failed", rich.Text)
+	assert.Equal(t, "#ff0000", rich.Attachments[0].Color)
+
+	_, err = parseRichMessage([]byte(`[{"type": "bogus"}]`))
+	assert.NotNil(t, err)
+
+	_, err = parseRichMessage([]byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+// Build a request signed the way Slack signs requests
+func newSignedSlackRequest(path string, form url.Values, secret string) *http.Request {
+	body := form.Encode()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestInteractionHandler(t *testing.T) {
+	secret := "s3cr3t"
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &TestSlackApi{}, &backendQs)
+	handler := backend.InteractionHandler(secret)
+
+	payload := `{
+		"type": "block_actions",
+		"user": {"id": "U234567"},
+		"channel": {"id": "C234567", "name": "TestChannel1"},
+		"container": {"type": "message", "message_ts": "1234.5678"},
+		"message": {"ts": "1234.5678", "thread_ts": "1234.0000"},
+		"actions": [
+			{"type": "static_select", "block_id": "menu", "action_id": "game", "selected_option": {"value": "rps"}}
+		]
+	}`
+	form := url.Values{"payload": {payload}}
+
+	t.Run("BlockAction", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newSignedSlackRequest("/slack/interactions", form, secret))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		select {
+		case got := <-backendQs.MesgQ:
+			assert.Equal(t, message.EventBlockAction, got.Event)
+			assert.Equal(t, "U234567", got.User)
+			assert.Equal(t, "C234567", got.ChannelId)
+			assert.Equal(t, "1234.0000", got.ThreadId)
+			assert.Equal(t, "1234.5678", got.Timestamp)
+			assert.Equal(t, "game", got.ActionId)
+			assert.Equal(t, "rps", got.ActionValue)
+		default:
+			assert.Fail(t, "Block action not delivered")
+		}
+	})
+
+	t.Run("BadSignature", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newSignedSlackRequest("/slack/interactions", form, "wrong"))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Len(t, backendQs.MesgQ, 0)
+	})
+}
+
+func TestCommandHandler(t *testing.T) {
+	secret := "s3cr3t"
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	api := TestSlackApi{
+		ChannelMap: map[string]string{
+			"C234567": "TestChannel1",
+		},
+		IMChannels: map[string]bool{
+			"D234567": true,
+		},
+	}
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	handler := backend.CommandHandler(secret)
+
+	tests := []struct {
+		channelId   string
+		channelName string
+		wantName    string
+		wantType    string
+	}{
+		{"C234567", "TestChannel1", "TestChannel1", message.ChannelTypeChannel},
+		{"D234567", "directmessage", "", message.ChannelTypeIM},
+	}
+	for _, test := range tests {
+		form := url.Values{
+			"command":      {"/deploy"},
+			"text":         {"staging"},
+			"user_id":      {"U234567"},
+			"channel_id":   {test.channelId},
+			"channel_name": {test.channelName},
+			"response_url": {"https://hooks.example.com/commands/1234"},
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newSignedSlackRequest("/slack/commands", form, secret))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		select {
+		case got := <-backendQs.MesgQ:
+			assert.Equal(t, message.EventSlashCommand, got.Event)
+			assert.Equal(t, "/deploy", got.Command)
+			assert.Equal(t, "staging", got.Text)
+			assert.Equal(t, "U234567", got.User)
+			assert.Equal(t, test.channelId, got.ChannelId)
+			assert.Equal(t, test.wantName, got.ChannelName)
+			assert.Equal(t, test.wantType, got.ChannelType)
+			assert.Equal(t, "https://hooks.example.com/commands/1234", got.ResponseURL)
+		default:
+			assert.Fail(t, "Slash command not delivered")
+		}
+	}
+}
+
+func TestPostToResponseURL(t *testing.T) {
+	api := TestSlackApi{
+		Posts:    make(chan TestSlackPost, 1),
+		Webhooks: make(chan *slack.WebhookMessage, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{
+		Text:        "Deploying to staging",
+		ChannelId:   "C234567",
+		ResponseURL: "https://hooks.example.com/commands/1234",
+	}
+
+	select {
+	case got := <-api.Webhooks:
+		assert.Equal(t, "Deploying to staging", got.Text)
+		assert.Equal(t, slack.ResponseTypeEphemeral, got.ResponseType)
+	case <-api.Posts:
+		assert.Fail(t, "Response posted to channel")
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "Response not posted")
+	}
+}
+
+func TestPostEphemeral(t *testing.T) {
+	api := TestSlackApi{
+		Posts:      make(chan TestSlackPost, 1),
+		Ephemerals: make(chan string, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{
+		Text:      "Only you can see this",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Action:    message.ActionEphemeral,
+	}
+
+	select {
+	case got := <-api.Ephemerals:
+		assert.Equal(t, "U234567", got)
+	case <-api.Posts:
+		assert.Fail(t, "Ephemeral message posted to channel")
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "Ephemeral message not posted")
+	}
+}
+
+func TestOpenIM(t *testing.T) {
+	api := TestSlackApi{}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	m := &message.Message{
+		ChannelId:     "C234567",
+		User:          "U234567",
+		Action:        message.ActionOpenIM,
+		ChannelIdChan: make(chan string, 1),
+	}
+	backendQs.RespQ <- m
+
+	select {
+	case got := <-m.ChannelIdChan:
+		assert.Equal(t, "DU234567", got)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "IM channel not opened")
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	alice := &slack.User{Name: "alice", RealName: "Alice Smith"}
+	alice.Profile.DisplayName = "ally"
+	api := TestSlackApi{
+		UserMap: map[string]*slack.User{"U234567": alice},
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+
+	text := "<@U234567> <@U999999> <!here> <!subteam^S123|@ops> see <#C123|general>: " +
+		"<https://example.com|docs>, <https://example.com>, <mailto:a@b.c|a@b.c> &amp; &lt;x&gt;"
+
+	tests := []struct {
+		opts message.SanitizeOptions
+		want string
+	}{
+		{message.SanitizeOptions{}, text},
+		{message.SanitizeOptions{Users: true}, text},
+		{
+			message.SanitizeOptions{Mentions: true},
+			"@ally @U999999 @here @ops see <#C123|general>: " +
+				"<https://example.com|docs>, <https://example.com>, <mailto:a@b.c|a@b.c> &amp; &lt;x&gt;",
+		},
+		{
+			message.SanitizeOptions{Links: true},
+			"<@U234567> <@U999999> <!here> <!subteam^S123|@ops> see #general: " +
+				"docs (https://example.com), https://example.com, a@b.c &amp; &lt;x&gt;",
+		},
+		{
+			message.SanitizeOptions{Mentions: true, Links: true, Entities: true},
+			"@ally @U999999 @here @ops see #general: " +
+				"docs (https://example.com), https://example.com, a@b.c & <x>",
+		},
+	}
+	for _, test := range tests {
+		m := &message.Message{User: "U234567", Text: text}
+		got := backend.Sanitize(m, test.opts)
+		assert.Equal(t, test.want, got.Text)
+
+		// The sender is only looked up if asked for
+		if test.opts.Users {
+			assert.Equal(t, "ally", got.UserName)
+			assert.Equal(t, "Alice Smith", got.UserRealName)
+			assert.Equal(t, "alice", got.UserHandle)
+		} else {
+			assert.Equal(t, "", got.UserName)
+			assert.Equal(t, "", got.UserHandle)
+		}
+
+		// The original message is left untouched for other conversations
+		assert.Equal(t, text, m.Text)
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	lookups := 0
+	cache := newUserCache(func(user string) (*slack.User, error) {
+		lookups++
+		if user == "U000000" {
+			return nil, errors.New("user_not_found")
+		}
+		return &slack.User{Name: user}, nil
+	}, time.Minute)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	assert.Equal(t, "U234567", cache.get("U234567").Name)
+	assert.Equal(t, "U234567", cache.get("U234567").Name)
+	assert.Nil(t, cache.get("U000000"))
+	assert.Nil(t, cache.get("U000000"))
+	assert.Equal(t, 2, lookups)
+
+	now = now.Add(2 * time.Minute)
+	cache.get("U234567")
+	assert.Equal(t, 3, lookups)
+
+	// Slow lookups don't hold up lookups of cached users
+	slow := make(chan bool)
+	cache.lookup = func(user string) (*slack.User, error) {
+		<-slow
+		return &slack.User{Name: user}, nil
+	}
+	looked := make(chan *slack.User)
+	go func() { looked <- cache.get("U345678") }()
+	got := make(chan *slack.User)
+	go func() { got <- cache.get("U234567") }()
+	select {
+	case u := <-got:
+		assert.Equal(t, "U234567", u.Name)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "Cached user held up by slow lookup")
+	}
+	close(slow)
+	assert.Equal(t, "U345678", (<-looked).Name)
+}
+
+func TestExpandMentions(t *testing.T) {
+	alice := &slack.User{Name: "alice"}
+	alice.Profile.DisplayName = "Ally"
+	// Display names can clash with usernames and each other
+	bob := &slack.User{Name: "bob"}
+	bob.Profile.DisplayName = "alice"
+	carol := &slack.User{Name: "carol"}
+	carol.Profile.DisplayName = "Sam"
+	dave := &slack.User{Name: "dave"}
+	dave.Profile.DisplayName = "sam"
+	ops := slack.Channel{}
+	ops.ID = "C345678"
+	ops.Name = "ops"
+	api := TestSlackApi{
+		UserMap: map[string]*slack.User{
+			"U234567": alice,
+			"U345678": bob,
+			"U456789": carol,
+			"U567890": dave,
+		},
+		Groups:      []slack.UserGroup{{ID: "S123456", Handle: "oncall"}},
+		ChannelList: []slack.Channel{ops},
+		Posts:       make(chan TestSlackPost, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"ping @alice.", "ping <@U234567>."},
+		{"@ally, see #ops", "<@U234567>, see <#C345678>"},
+		{"@here @oncall", "<!here> <!subteam^S123456>"},
+		{"@bob in #nowhere", "<@U345678> in #nowhere"},
+		{"@sam", "@sam"},
+		{"@carol", "<@U456789>"},
+		{"mail alice@example.com", "mail alice@example.com"},
+		{"run `say @alice` then ```\n@alice\n``` @alice", "run `say @alice` then ```\n@alice\n``` <@U234567>"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, backend.expandMentions(test.text))
+	}
+
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{ChannelId: "C234567", Text: "@alice"}
+	backendQs.RespQ <- &message.Message{ChannelId: "C234567", Text: "@alice", ExpandMentions: true}
+	for _, want := range []string{"@alice", "<@U234567>"} {
+		select {
+		case post := <-api.Posts:
+			_, values, err := slack.UnsafeApplyMsgOptions("", post.ChannelId, "", post.Options...)
+			assert.Nil(t, err)
+			assert.Equal(t, want, values.Get("text"))
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "message not posted")
+		}
+	}
+}
+
+func TestExpandNewlines(t *testing.T) {
+	api := TestSlackApi{
+		Posts: make(chan TestSlackPost, 1),
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	go backend.Post()
+	defer close(backendQs.RespQ)
+
+	backendQs.RespQ <- &message.Message{ChannelId: "C234567", Text: `a\nb`, ExpandNewlines: true}
+	backendQs.RespQ <- &message.Message{ChannelId: "C234567", Text: "```\nprintf(\"x\\n\");\n```"}
+	for _, want := range []string{"a\nb", "```\nprintf(\"x\\n\");\n```"} {
+		select {
+		case post := <-api.Posts:
+			_, values, err := slack.UnsafeApplyMsgOptions("", post.ChannelId, "", post.Options...)
+			assert.Nil(t, err)
+			assert.Equal(t, want, values.Get("text"))
+		case <-time.After(500 * time.Millisecond):
+			assert.Fail(t, "message not posted")
+		}
+	}
+}
+
+func TestInUserGroup(t *testing.T) {
+	api := TestSlackApi{
+		Groups: []slack.UserGroup{{ID: "S123456", Handle: "oncall", Users: []string{"U234567"}}},
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+
+	assert.True(t, backend.InUserGroup("U234567", "oncall"))
+	assert.True(t, backend.InUserGroup("U234567", "@OnCall"))
+	assert.True(t, backend.InUserGroup("U234567", "S123456"))
+	assert.False(t, backend.InUserGroup("U345678", "oncall"))
+	assert.False(t, backend.InUserGroup("U234567", "admins"))
+}
+
+// Slack API whose user group lists are loaded from a channel, and which
+// counts the user lists loaded
+type slowDirectoryApi struct {
+	TestSlackApi
+	groups chan []slack.UserGroup
+	users  *int
+}
+
+func (s slowDirectoryApi) UserGroups() ([]slack.UserGroup, error) {
+	return <-s.groups, nil
+}
+
+func (s slowDirectoryApi) Users() ([]slack.User, error) {
+	*s.users++
+	return nil, nil
+}
+
+func TestDirectoryRefresh(t *testing.T) {
+	api := slowDirectoryApi{groups: make(chan []slack.UserGroup), users: new(int)}
+	d := newSlackDirectory(api, time.Minute)
+	now := time.Now()
+	// The directory only checks the time with its lock held
+	d.now = func() time.Time { return now }
+
+	// Lookups wait for lists which have never been loaded
+	go func() {
+		api.groups <- []slack.UserGroup{{ID: "S123456", Handle: "oncall", Users: []string{"U234567"}}}
+	}()
+	assert.True(t, d.inGroup("U234567", "oncall"))
+
+	// Expired lists are reloaded in the background, and used as they were
+	// until the reload finishes
+	d.lock.Lock()
+	now = now.Add(2 * time.Minute)
+	d.lock.Unlock()
+	assert.True(t, d.inGroup("U234567", "oncall"))
+	assert.False(t, d.inGroup("U345678", "oncall"))
+
+	api.groups <- []slack.UserGroup{{ID: "S123456", Handle: "oncall", Users: []string{"U345678"}}}
+	assert.Eventually(t, func() bool { return d.inGroup("U345678", "oncall") },
+		time.Second, 5*time.Millisecond)
+	assert.False(t, d.inGroup("U234567", "oncall"))
+
+	// Only the lists needed are loaded
+	assert.Equal(t, 0, *api.users)
+}
+
+func TestChannelCache(t *testing.T) {
+	lookups := 0
+	cache := newChannelCache(func(channel string) *slack.Channel {
+		lookups++
+		return &slack.Channel{}
+	}, time.Minute)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.get("C234567")
+	cache.get("C234567")
+	assert.Equal(t, 1, lookups)
+
+	cache.invalidate("C234567")
+	cache.get("C234567")
+	assert.Equal(t, 2, lookups)
+
+	now = now.Add(2 * time.Minute)
+	cache.get("C234567")
+	assert.Equal(t, 3, lookups)
+}
+
+func TestChannelRename(t *testing.T) {
+	api := TestSlackApi{
+		ChannelMap: map[string]string{"C234567": "general"},
+		Events: []TestSlackEvent{
+			{Type: TestEventChannelRename, ChannelId: "C234567", Message: "lobby"},
+		},
+	}
+
+	backendQs := NewBackendQueues(DefaultQBufferSize)
+	backend := newTestSlackBackend(t, &api, &backendQs)
+	assert.Equal(t, "general", backend.channelInfo("C234567").Name)
+
+	api.ChannelMap["C234567"] = "lobby"
+	assert.Equal(t, "general", backend.channelInfo("C234567").Name)
+
+	backend.Read()
+	assert.Equal(t, "lobby", backend.channelInfo("C234567").Name)
+}
+
+func TestSplitText(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitText("short", 10))
+	assert.Equal(t, []string{"one two", "three"}, splitText("one two\nthree", 10))
+	assert.Equal(t, []string{"abcdefghij", "klm"}, splitText("abcdefghijklm", 10))
+	assert.Equal(t, []string{"ééééé", "éé"}, splitText("ééééééé", 5))
+}
+
 func TestMain(m *testing.M) {
 	logrus.SetLevel(logrus.DebugLevel)
 
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// How long channel details looked up from Slack are cached for. Renames and
+// archiving invalidate cached channels sooner, if the events are seen.
+const chanCacheTTL = 10 * time.Minute
+
+type cachedChannel struct {
+	channel *slack.Channel
+	expires time.Time
+}
+
+// Cache of conversations.info lookups, safe for use from both the reader
+// and the conversation manager
+type channelCache struct {
+	lock     sync.Mutex
+	channels map[string]cachedChannel
+	ttl      time.Duration
+	lookup   func(channel string) *slack.Channel
+	now      func() time.Time
+}
+
+func newChannelCache(lookup func(channel string) *slack.Channel, ttl time.Duration) *channelCache {
+	return &channelCache{
+		channels: make(map[string]cachedChannel),
+		ttl:      ttl,
+		lookup:   lookup,
+		now:      time.Now,
+	}
+}
+
+func (cc *channelCache) get(id string) *slack.Channel {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if c, ok := cc.channels[id]; ok && cc.now().Before(c.expires) {
+		return c.channel
+	}
+
+	channel := cc.lookup(id)
+	cc.channels[id] = cachedChannel{channel: channel, expires: cc.now().Add(cc.ttl)}
+	return channel
+}
+
+// Drop a channel from the cache, so that it is looked up afresh when next
+// needed
+func (cc *channelCache) invalidate(id string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	delete(cc.channels, id)
+}
@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How long the workspace directory is cached for before being reloaded
+const directoryTTL = 1 * time.Hour
+
+// Workspace users, user groups, and channels, indexed by name for
+// expanding mentions in messages posted by bots, and the members of user
+// groups.
+//
+// Each list is reloaded on its own once expired. Reloads are done in the
+// background, and lookups use the lists already loaded until they finish,
+// so that a slow reload doesn't hold up lookups.
+type slackDirectory struct {
+	lock sync.Mutex
+	api  SlackApier
+	ttl  time.Duration
+	now  func() time.Time
+
+	users    map[string]string
+	groups   map[string]string
+	channels map[string]string
+
+	// Members of user groups, by group ID
+	members map[string]map[string]bool
+
+	userList    *directoryList
+	groupList   *directoryList
+	channelList *directoryList
+}
+
+// One of the lists in the workspace directory
+type directoryList struct {
+	name string
+
+	// Loads the list, returning a function which stores it in the
+	// directory. The store function is called with the directory locked.
+	load func() (func(), error)
+
+	expires time.Time
+	loading bool
+
+	// Closed once the list has first been loaded, or failed to load
+	ready chan struct{}
+}
+
+func newSlackDirectory(api SlackApier, ttl time.Duration) *slackDirectory {
+	d := &slackDirectory{
+		api: api,
+		ttl: ttl,
+		now: time.Now,
+	}
+	d.userList = newDirectoryList("users", d.loadUsers)
+	d.groupList = newDirectoryList("user groups", d.loadGroups)
+	d.channelList = newDirectoryList("channels", d.loadChannels)
+	return d
+}
+
+func newDirectoryList(name string, load func() (func(), error)) *directoryList {
+	return &directoryList{
+		name:  name,
+		load:  load,
+		ready: make(chan struct{}),
+	}
+}
+
+// Start reloading lists in the background if they have expired. Only waits
+// for lists which have never been loaded. Needs the lock held, which is
+// released while waiting.
+func (d *slackDirectory) refresh(lists ...*directoryList) {
+	for _, l := range lists {
+		if !l.loading && !d.now().Before(l.expires) {
+			l.loading = true
+			go d.reload(l)
+		}
+	}
+
+	for _, l := range lists {
+		select {
+		case <-l.ready:
+		default:
+			d.lock.Unlock()
+			<-l.ready
+			d.lock.Lock()
+		}
+	}
+}
+
+// Load a list without holding the lock. Lists which can't be loaded are left
+// as they were, and retried once they expire again.
+func (d *slackDirectory) reload(l *directoryList) {
+	logrus.Debugf("Loading Slack %s", l.name)
+	store, err := l.load()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err != nil {
+		logrus.Errorf("Error loading %s: %v", l.name, err)
+	} else {
+		store()
+	}
+	l.expires = d.now().Add(d.ttl)
+	l.loading = false
+
+	select {
+	case <-l.ready:
+	default:
+		close(l.ready)
+	}
+}
+
+func (d *slackDirectory) loadUsers() (func(), error) {
+	list, err := d.api.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	// Display names aren't unique and can be changed by users to anything,
+	// so they are only used if they don't clash with a username or another
+	// user's display name. An empty ID marks a display name used by more
+	// than one user.
+	displayNames := make(map[string]string)
+	for _, u := range list {
+		if u.Deleted {
+			continue
+		}
+		users[strings.ToLower(u.Name)] = u.ID
+		if u.Profile.DisplayName != "" {
+			name := strings.ToLower(u.Profile.DisplayName)
+			if id, exists := displayNames[name]; exists && id != u.ID {
+				displayNames[name] = ""
+			} else {
+				displayNames[name] = u.ID
+			}
+		}
+	}
+	for name, id := range displayNames {
+		if _, exists := users[name]; !exists && id != "" {
+			users[name] = id
+		}
+	}
+
+	return func() { d.users = users }, nil
+}
+
+func (d *slackDirectory) loadGroups() (func(), error) {
+	list, err := d.api.UserGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]string)
+	members := make(map[string]map[string]bool)
+	for _, g := range list {
+		groups[strings.ToLower(g.Handle)] = g.ID
+		members[g.ID] = make(map[string]bool)
+		for _, u := range g.Users {
+			members[g.ID][u] = true
+		}
+	}
+
+	return func() {
+		d.groups = groups
+		d.members = members
+	}, nil
+}
+
+func (d *slackDirectory) loadChannels() (func(), error) {
+	list, err := d.api.Channels()
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make(map[string]string)
+	for _, c := range list {
+		channels[strings.ToLower(c.Name)] = c.ID
+	}
+
+	return func() { d.channels = channels }, nil
+}
+
+// Slack markup for a mention of a user or user group, or "" if the name
+// is unknown
+func (d *slackDirectory) mention(name string) string {
+	switch name = strings.ToLower(name); name {
+	case "here", "channel", "everyone":
+		return "<!" + name + ">"
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.refresh(d.userList, d.groupList)
+
+	if id, ok := d.users[name]; ok {
+		return "<@" + id + ">"
+	}
+	if id, ok := d.groups[name]; ok {
+		return "<!subteam^" + id + ">"
+	}
+	return ""
+}
+
+// Slack markup for a reference to a channel, or "" if the name is unknown
+func (d *slackDirectory) channel(name string) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.refresh(d.channelList)
+
+	if id, ok := d.channels[strings.ToLower(name)]; ok {
+		return "<#" + id + ">"
+	}
+	return ""
+}
+
+// Check if a user is a member of a user group, given by ID or handle
+func (d *slackDirectory) inGroup(user string, group string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.refresh(d.groupList)
+
+	group = strings.TrimPrefix(group, "@")
+	if id, ok := d.groups[strings.ToLower(group)]; ok {
+		group = id
+	}
+	return d.members[group][user]
+}
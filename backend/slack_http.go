@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/venkytv/botmand/message"
+)
+
+// Read the body of a request from Slack, verifying its signature
+func verifySlackRequest(r *http.Request, signingSecret string) ([]byte, error) {
+	verifier, err := slack.NewSecretsVerifier(r.Header, signingSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(io.TeeReader(r.Body, &verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifier.Ensure(); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Return the value chosen in an interactive element
+func blockActionValue(action *slack.BlockAction) string {
+	switch {
+	case action.Value != "":
+		return action.Value
+	case action.SelectedOption.Value != "":
+		return action.SelectedOption.Value
+	case len(action.SelectedOptions) > 0:
+		values := []string{}
+		for _, option := range action.SelectedOptions {
+			values = append(values, option.Value)
+		}
+		return strings.Join(values, ",")
+	case action.SelectedUser != "":
+		return action.SelectedUser
+	case len(action.SelectedUsers) > 0:
+		return strings.Join(action.SelectedUsers, ",")
+	case action.SelectedChannel != "":
+		return action.SelectedChannel
+	case action.SelectedConversation != "":
+		return action.SelectedConversation
+	case action.SelectedDate != "":
+		return action.SelectedDate
+	case action.SelectedTime != "":
+		return action.SelectedTime
+	}
+	return ""
+}
+
+func (s SlackBackend) newBlockActionMessage(cb *slack.InteractionCallback, action *slack.BlockAction) *message.Message {
+	timestamp := cb.Container.MessageTs
+	if timestamp == "" {
+		timestamp = cb.Message.Timestamp
+	}
+
+	return &message.Message{
+		User:        cb.User.ID,
+		ChannelId:   cb.Channel.ID,
+		ChannelName: cb.Channel.Name,
+		ThreadId:    cb.Message.ThreadTimestamp,
+		InThread:    cb.Message.ThreadTimestamp != "",
+		Timestamp:   timestamp,
+		Event:       message.EventBlockAction,
+		ActionId:    action.ActionID,
+		ActionValue: blockActionValue(action),
+	}
+}
+
+// InteractionHandler returns a handler for Slack interactivity requests.
+// Actions on interactive elements in messages posted by bots, such as
+// buttons and menus, are delivered back to the conversations which posted
+// them.
+func (s *SlackBackend) InteractionHandler(signingSecret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := verifySlackRequest(r, signingSecret)
+		if err != nil {
+			logrus.Warnf("Rejecting interaction request: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var cb slack.InteractionCallback
+		if err := json.Unmarshal([]byte(form.Get("payload")), &cb); err != nil {
+			logrus.Warnf("Invalid interaction payload: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if cb.Type != slack.InteractionTypeBlockActions {
+			logrus.Debugf("Ignoring interaction: %s", cb.Type)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		for _, action := range cb.ActionCallback.BlockActions {
+			m := s.newBlockActionMessage(&cb, action)
+			logrus.Debugf("Block action: %#v", m)
+			s.comm.MesgQ <- m
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// CommandHandler returns a handler for Slack slash command requests, which
+// are delivered to the conversation manager to start bot conversations
+func (s *SlackBackend) CommandHandler(signingSecret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := verifySlackRequest(r, signingSecret)
+		if err != nil {
+			logrus.Warnf("Rejecting slash command request: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		cmd, err := slack.SlashCommandParse(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Slack names direct message channels "directmessage", so look
+		// up the channel for its real name and type
+		channelName, channelType := s.LookupChannel(cmd.ChannelID)
+
+		m := &message.Message{
+			Text:          cmd.Text,
+			User:          cmd.UserID,
+			BotUserId:     s.botId,
+			BotUserName:   s.botName,
+			ChannelId:     cmd.ChannelID,
+			ChannelName:   channelName,
+			ChannelType:   channelType,
+			DirectMessage: true,
+			Event:         message.EventSlashCommand,
+			Command:       cmd.Command,
+			ResponseURL:   cmd.ResponseURL,
+		}
+		logrus.Debugf("Slash command: %#v", m)
+		s.comm.MesgQ <- m
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
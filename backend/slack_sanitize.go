@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/venkytv/botmand/message"
+)
+
+// Slack markup enclosed in angle brackets: user and channel references,
+// special mentions, and links, each optionally followed by a label
+var slackMarkupPattern = regexp.MustCompile(`<([@#!]?)([^<>|]+)(?:\|([^<>]*))?>`)
+
+func (s SlackBackend) Sanitize(m *message.Message, opts message.SanitizeOptions) *message.Message {
+	if opts.Users && m.User != "" && m.UserName == "" && s.users != nil {
+		if u := s.users.get(m.User); u != nil {
+			m.UserName = displayName(u)
+			m.UserRealName = realName(u)
+			m.UserHandle = u.Name
+		}
+	}
+
+	if !opts.Mentions && !opts.Links && !opts.Entities {
+		return m
+	}
+
+	// Messages are shared between conversations, which may sanitise them
+	// differently
+	sm := *m
+	sm.Text = s.sanitizeText(m.Text, opts)
+	return &sm
+}
+
+func (s SlackBackend) sanitizeText(text string, opts message.SanitizeOptions) string {
+	if opts.Mentions || opts.Links {
+		text = slackMarkupPattern.ReplaceAllStringFunc(text, func(markup string) string {
+			parts := slackMarkupPattern.FindStringSubmatch(markup)
+			sigil, target, label := parts[1], parts[2], parts[3]
+
+			switch sigil {
+			case "@":
+				if !opts.Mentions {
+					return markup
+				}
+				if label != "" {
+					return "@" + label
+				}
+				if s.users != nil {
+					if u := s.users.get(target); u != nil {
+						return "@" + displayName(u)
+					}
+				}
+				return "@" + target
+
+			case "!":
+				if !opts.Mentions {
+					return markup
+				}
+				// Special mentions (<!here>) and user groups
+				// (<!subteam^S123|@team>)
+				if label != "" {
+					return label
+				}
+				return "@" + target
+
+			case "#":
+				if !opts.Links {
+					return markup
+				}
+				if label == "" {
+					label = target
+				}
+				return "#" + label
+
+			default:
+				if !opts.Links {
+					return markup
+				}
+				switch label {
+				case "":
+					return target
+				case target, strings.TrimPrefix(target, "mailto:"):
+					return label
+				}
+				return label + " (" + target + ")"
+			}
+		})
+	}
+
+	if opts.Entities {
+		text = html.UnescapeString(text)
+	}
+
+	return text
+}
+
+// Mentions of users and groups (@alice) and channels (#ops) in text posted
+// by bots. Names must follow the start of the text, whitespace, or
+// punctuation, so that email addresses and URL fragments are left alone.
+var plainMentionPattern = regexp.MustCompile(`(^|[\s(\[{,;:"'])([@#])([\w][\w.\-]*)`)
+
+// Code spans and blocks, in which mentions are left as they are
+var codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+
+// Translate plain mentions of users, user groups, and channels in text
+// posted by bots into Slack markup. Unknown names are left as they are.
+func (s SlackBackend) expandMentions(text string) string {
+	if s.directory == nil {
+		return text
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, loc := range codePattern.FindAllStringIndex(text, -1) {
+		sb.WriteString(s.expandPlainMentions(text[last:loc[0]]))
+		sb.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(s.expandPlainMentions(text[last:]))
+	return sb.String()
+}
+
+func (s SlackBackend) expandPlainMentions(text string) string {
+	return plainMentionPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := plainMentionPattern.FindStringSubmatch(match)
+		lead, sigil, name := parts[1], parts[2], parts[3]
+
+		// Leave trailing punctuation ("ping @alice.") out of the name
+		trimmed := strings.TrimRight(name, ".-")
+		trailer := name[len(trimmed):]
+
+		var markup string
+		if sigil == "@" {
+			markup = s.directory.mention(trimmed)
+		} else {
+			markup = s.directory.channel(trimmed)
+		}
+		if markup == "" {
+			return match
+		}
+		return lead + markup + trailer
+	})
+}
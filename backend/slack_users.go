@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// How long user details looked up from Slack are cached for
+const userCacheTTL = 1 * time.Hour
+
+type cachedUser struct {
+	user    *slack.User
+	expires time.Time
+}
+
+// Cache of users.info lookups, safe for use from both the reader and the
+// conversation manager
+type userCache struct {
+	lock   sync.Mutex
+	users  map[string]cachedUser
+	ttl    time.Duration
+	lookup func(user string) (*slack.User, error)
+	now    func() time.Time
+}
+
+func newUserCache(lookup func(user string) (*slack.User, error), ttl time.Duration) *userCache {
+	return &userCache{
+		users:  make(map[string]cachedUser),
+		ttl:    ttl,
+		lookup: lookup,
+		now:    time.Now,
+	}
+}
+
+// Look up a user, returning nil if the user is unknown. Failed lookups are
+// cached too, so that a missing user doesn't cost an API call per message.
+// Users are looked up without holding the lock, so that a slow lookup doesn't
+// hold up lookups of users already cached.
+func (uc *userCache) get(id string) *slack.User {
+	uc.lock.Lock()
+	cu, ok := uc.users[id]
+	fresh := ok && uc.now().Before(cu.expires)
+	uc.lock.Unlock()
+	if fresh {
+		return cu.user
+	}
+
+	logrus.Debug("Looking up user info for ", id)
+	user, err := uc.lookup(id)
+	if err != nil {
+		logrus.Errorf("Error looking up user info: %s: %v", id, err)
+		user = nil
+	}
+
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	uc.users[id] = cachedUser{user: user, expires: uc.now().Add(uc.ttl)}
+	return user
+}
+
+// Name a user is shown as in Slack: the display name if set, falling back
+// to the real name and then the username
+func displayName(u *slack.User) string {
+	switch {
+	case u.Profile.DisplayName != "":
+		return u.Profile.DisplayName
+	case realName(u) != "":
+		return realName(u)
+	}
+	return u.Name
+}
+
+func realName(u *slack.User) string {
+	if u.RealName != "" {
+		return u.RealName
+	}
+	return u.Profile.RealName
+}
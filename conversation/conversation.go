@@ -1,12 +1,15 @@
 package conversation
 
 import (
-	"bufio"
 	"context"
 	"io"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/venkytv/botmand/engine"
+	"github.com/venkytv/botmand/globals"
 	"github.com/venkytv/botmand/message"
 )
 
@@ -27,12 +30,100 @@ type Conversation struct {
 	engineQueues       engine.EngineQueues
 	prefixUsername     bool
 	directMessagesOnly bool
+	outputFraming      string
+	outputTerminator   string
+	maxLineSize        int
+	uploadMaxSize      int64
+	uploadDir          string
+	removeUploads      bool
+	deliverFiles       bool
+	downloadMaxSize    int64
+	deliverReactions   bool
+	deliverEdits       bool
+	eventPrefix        string
+	sanitize           message.SanitizeOptions
+	expandMentions     bool
+
+	// Channels the bot can post to outside the conversation, by name or ID
+	postChannels []string
+
+	// Set if no other bot can join the conversation's thread
+	exclusive bool
+
+	// Bots the conversation can be handed off to
+	handoffTo []string
+
+	// Message which started the conversation
+	origin message.Message
+
+	// Directory downloaded files are saved in, if enabled
+	scratchDir string
+
+	// Set for threaded conversations whose thread will be started by the
+	// bot's first message
+	pendingThread bool
+
+	// Set for conversations which respond only to the user who started them
+	responseURL string
+
+	history *messageHistory
 
 	// Flag to indicate that the conversation is closing
 	convClosing bool
+
+	// Closed once the conversation has ended
+	done    chan struct{}
+	endOnce sync.Once
+
+	// Closed to close the bot's stdin
+	stdinDone chan struct{}
+	stdinOnce sync.Once
+
+	// Closed once input held back for slow work, such as file downloads,
+	// has been passed to the bot. Later input waits for it, to stay in order.
+	inputLock  sync.Mutex
+	inputReady chan struct{}
+}
+
+// Check if the bot is allowed to post to a channel outside the conversation
+func (c *Conversation) canPostTo(channel string) bool {
+	for _, allowed := range c.postChannels {
+		if strings.TrimPrefix(allowed, "#") == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the conversation can be handed off to a bot
+func (c *Conversation) canHandoffTo(bot string) bool {
+	for _, allowed := range c.handoffTo {
+		if allowed == bot {
+			return true
+		}
+	}
+	return false
+}
+
+// Close the bot's stdin, so that it sees the end of its input
+func (c *Conversation) closeStdin() {
+	c.stdinOnce.Do(func() { close(c.stdinDone) })
+}
+
+// Check if the conversation is still running
+func (c *Conversation) active() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
 }
 
 func (c *Conversation) Start(ctx context.Context) {
+	// Conversations started by this one outlive it
+	parentCtx := ctx
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -48,7 +139,7 @@ func (c *Conversation) Start(ctx context.Context) {
 					ChannelName: c.channelName,
 					ThreadId:    c.threadId,
 				}
-				c.manager.Post(c, m)
+				c.manager.Post(parentCtx, c, m)
 			} else {
 				logrus.Debug("Done with conversation")
 				return
@@ -88,6 +179,9 @@ func (c *Conversation) LaunchEngine(ctx context.Context) {
 				if _, err := io.WriteString(stdin, t+"\n"); err != nil {
 					logrus.Errorf("Failed to post message to command: '%s' (%v)", t, err)
 				}
+			case <-c.stdinDone:
+				logrus.Debug("Closing stdin at bot's request")
+				return
 			case <-ctx.Done():
 				logrus.Debug("Closing stdin channel")
 				return
@@ -97,21 +191,26 @@ func (c *Conversation) LaunchEngine(ctx context.Context) {
 
 	// Pipe output of command to ReadQ
 	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			t := scanner.Text()
+		scanner := newLineScanner(stdout, c.maxLineSize)
+		err := readFrames(scanner, c.outputFraming, c.outputTerminator, func(t string) {
 			c.engineQueues.ReadQ <- t
+		})
+		if err != nil {
+			logrus.Errorf("Error reading output of bot %s: %v", c.engineName, err)
 		}
 		logrus.Debug("Closing stdout channel")
 	}()
 
 	// Log stderr
 	go func() {
-		scanner := bufio.NewScanner(stderr)
+		scanner := newLineScanner(stderr, c.maxLineSize)
 		for scanner.Scan() {
 			t := scanner.Text()
 			logrus.Debug("Engine stderr:", t)
 		}
+		if err := scanner.Err(); err != nil {
+			logrus.Errorf("Error reading stderr of bot %s: %v", c.engineName, err)
+		}
 		logrus.Debug("Closing stderr channel")
 	}()
 
@@ -128,14 +227,146 @@ func (c *Conversation) LaunchEngine(ctx context.Context) {
 	}
 }
 
+// Pass lines of input to the bot. Slow input is prepared without holding up
+// the caller, and input is passed to the bot in the order it was posted.
+func (c *Conversation) sendInput(slow bool, lines func() []string) {
+	c.inputLock.Lock()
+	defer c.inputLock.Unlock()
+
+	prev := c.inputReady
+	if !slow && isClosed(prev) {
+		c.writeInput(lines())
+		return
+	}
+
+	ready := make(chan struct{})
+	c.inputReady = ready
+	go func() {
+		defer close(ready)
+		input := lines()
+		if prev != nil {
+			<-prev
+		}
+		c.writeInput(input)
+	}()
+}
+
+func (c *Conversation) writeInput(lines []string) {
+	for _, line := range lines {
+		if c.convClosing || !c.active() {
+			logrus.Debugf("Conversation is closing, not passing input to bot: %s", line)
+			return
+		}
+		c.engineQueues.WriteQ <- line
+	}
+}
+
+// Check if a channel is closed. A nil channel counts as closed.
+func isClosed(ch chan struct{}) bool {
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *Conversation) Post(m *message.Message) {
-	if c.convClosing {
+	if c.convClosing || !c.active() {
 		logrus.Debugf("Conversation is closing, not posting message: %#v: %s", c, m.Text)
 		return
 	}
+
+	switch m.Event {
+	case message.EventReactionAdded, message.EventReactionRemoved:
+		if !c.deliverReactions {
+			return
+		}
+		kind := "reaction/added"
+		if m.Event == message.EventReactionRemoved {
+			kind = "reaction/removed"
+		}
+		c.send(c.eventLine(kind, url.Values{
+			"reaction": {m.Reaction},
+			"user":     {m.User},
+			"ts":       {m.Timestamp},
+		}))
+		return
+
+	case message.EventMessageChanged, message.EventMessageDeleted:
+		if !c.deliverEdits {
+			return
+		}
+		kind := "message/changed"
+		if m.Event == message.EventMessageDeleted {
+			kind = "message/deleted"
+		}
+		if m.Event == message.EventMessageChanged {
+			m = c.manager.backend.Sanitize(m, c.sanitize)
+		}
+		c.send(c.eventLine(kind, url.Values{
+			"text": {m.Text},
+			"user": {m.User},
+			"ts":   {m.Timestamp},
+		}))
+		return
+
+	case message.EventBlockAction:
+		c.send(c.eventLine("action", url.Values{
+			"action_id": {m.ActionId},
+			"value":     {m.ActionValue},
+			"user":      {m.User},
+			"ts":        {m.Timestamp},
+		}))
+		return
+	}
+
+	c.history.addUser(m.Timestamp, m.User)
+
+	m = c.manager.backend.Sanitize(m, c.sanitize)
+
 	msg := m.Text
-	if c.prefixUsername {
-		msg = m.User + ": " + msg
+	if c.prefixUsername && m.User != "" {
+		user := m.User
+		if c.sanitize.Mentions && m.UserName != "" {
+			user = m.UserName
+		}
+		msg = user + ": " + msg
+	}
+	if !c.deliverFiles || len(m.Files) == 0 {
+		c.send(msg)
+		return
+	}
+
+	// Files are downloaded outside the manager's loop, so that large files
+	// don't hold up messages for other conversations
+	c.sendInput(c.scratchDir != "", func() []string {
+		lines := []string{msg}
+		paths := c.downloadFiles(m.Files)
+		for i := range m.Files {
+			lines = append(lines, c.fileLine(m, &m.Files[i], paths[i]))
+		}
+		return lines
+	})
+}
+
+// Pass a line of input to the bot
+func (c *Conversation) send(line string) {
+	c.sendInput(false, func() []string { return []string{line} })
+}
+
+// Describe an event to the bot in a line of the form:
+//
+//	<prefix><kind>?<url-encoded parameters>
+//
+// The prefix is "botmand://" unless configured otherwise
+func (c *Conversation) eventLine(kind string, params url.Values) string {
+	prefix := c.eventPrefix
+	if prefix == "" {
+		prefix = globals.BotUrlScheme
 	}
-	c.engineQueues.WriteQ <- msg
+	return prefix + kind + "?" + params.Encode()
 }
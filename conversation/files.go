@@ -0,0 +1,104 @@
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/venkytv/botmand/message"
+)
+
+var errFileTooLarge = errors.New("file too large")
+
+// Writer which fails once more than a limit of bytes is written to it, as
+// the size the backend reports for a file can't be relied on
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.n {
+		return 0, errFileTooLarge
+	}
+	lw.n -= int64(len(p))
+	return lw.w.Write(p)
+}
+
+// Download a file attached to a message into the conversation's scratch
+// directory and return the local path
+func (c *Conversation) downloadFile(f *message.File) (string, error) {
+	if f.Size > c.downloadMaxSize {
+		return "", fmt.Errorf("%w: %d bytes (limit %d)", errFileTooLarge, f.Size, c.downloadMaxSize)
+	}
+
+	// Don't trust the file name to stay within the scratch directory, and
+	// keep files with the same name apart
+	out, err := os.CreateTemp(c.scratchDir, "*-"+filepath.Base(filepath.Clean("/"+f.Name)))
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	path := out.Name()
+
+	w := &limitedWriter{w: out, n: c.downloadMaxSize}
+	if err := c.manager.backend.DownloadFile(f.URL, w); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Download the files attached to a message, if enabled, and return their
+// local paths. Files which aren't downloaded have no path.
+func (c *Conversation) downloadFiles(files []message.File) []string {
+	paths := make([]string, len(files))
+	if c.scratchDir == "" {
+		return paths
+	}
+
+	for i := range files {
+		path, err := c.downloadFile(&files[i])
+		if err != nil {
+			logrus.Warnf("Failed to download file for bot %s: %s: %v", c.engineName, files[i].Name, err)
+			continue
+		}
+		paths[i] = path
+	}
+	return paths
+}
+
+// Describe a file attached to a message in an event line of the form:
+//
+//	botmand://file?mimetype=text%2Fplain&name=app.log&path=...&size=1234&url=...
+//
+// The path is only set if the file has been downloaded
+func (c *Conversation) fileLine(m *message.Message, f *message.File, path string) string {
+	params := url.Values{}
+	params.Set("name", f.Name)
+	params.Set("mimetype", f.Mimetype)
+	params.Set("size", strconv.FormatInt(f.Size, 10))
+	params.Set("url", f.URL)
+	params.Set("user", m.User)
+	if path != "" {
+		params.Set("path", path)
+	}
+
+	return c.eventLine("file", params)
+}
+
+// Remove the conversation's scratch directory, if it has one
+func (c *Conversation) removeScratchDir() {
+	if c.scratchDir == "" {
+		return
+	}
+	if err := os.RemoveAll(c.scratchDir); err != nil {
+		logrus.Warnf("Failed to remove scratch directory: %s: %v", c.scratchDir, err)
+	}
+}
@@ -0,0 +1,174 @@
+package conversation
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venkytv/botmand/message"
+)
+
+// Backend whose downloads wait until released
+type slowBackend struct {
+	TestBackend
+	release chan struct{}
+}
+
+func (b slowBackend) DownloadFile(url string, w io.Writer) error {
+	<-b.release
+	return b.TestBackend.DownloadFile(url, w)
+}
+
+// Parameters of a file line echoed by a bot with "event-prefix: file:"
+func fileParams(t *testing.T, text string) url.Values {
+	assert.True(t, strings.HasPrefix(text, "file:file?"), text)
+	params, err := url.ParseQuery(strings.TrimPrefix(text, "file:file?"))
+	assert.Nil(t, err)
+	return params
+}
+
+func TestDownloadFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Scratch directories are created here
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	common := "handler: cat\ndownload-files: true\ndirect-message-triggers-only: false\nevent-prefix: 'file:'\n"
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"filebot":  common + "channels: [C234567]\n",
+		"otherbot": common + "channels: [C234567]\n",
+		"smallbot": common + "channels: [C345678]\ndownload-max-size: 10\n",
+	})
+
+	file := message.File{Name: "../app.log", Size: 5, URL: "https://files.example.com/app.log"}
+
+	t.Run("PerConversation", func(t *testing.T) {
+		qs.MesgQ <- &message.Message{
+			Text:      "see attached",
+			User:      "U234567",
+			ChannelId: "C234567",
+			Files:     []message.File{file},
+		}
+
+		// Each bot downloads the file into its own scratch directory
+		paths := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			resp := expectResponse(t, qs)
+			if resp.Text == "see attached" {
+				continue
+			}
+			path := fileParams(t, resp.Text).Get("path")
+			assert.True(t, strings.HasSuffix(filepath.Base(path), "-app.log"), path)
+			content, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, file.URL, string(content))
+			paths[path] = true
+		}
+		assert.Equal(t, 2, len(paths))
+
+		// Messages to bots already active don't leave scratch directories
+		// behind
+		for i := 0; i < 5; i++ {
+			qs.MesgQ <- &message.Message{Text: "more", User: "U234567", ChannelId: "C234567"}
+			expectResponse(t, qs)
+			expectResponse(t, qs)
+		}
+		dirs, err := filepath.Glob(filepath.Join(tmpDir, "botmand-*"))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(dirs))
+	})
+
+	t.Run("SameName", func(t *testing.T) {
+		other := file
+		other.URL = "https://files.example.com/other/app.log"
+		qs.MesgQ <- &message.Message{
+			Text:      "two logs",
+			User:      "U234567",
+			ChannelId: "C234567",
+			Files:     []message.File{file, other},
+		}
+
+		// Files with the same name don't overwrite each other
+		contents := map[string]string{}
+		for i := 0; i < 6; i++ {
+			resp := expectResponse(t, qs)
+			if resp.Text == "two logs" {
+				continue
+			}
+			path := fileParams(t, resp.Text).Get("path")
+			content, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			contents[path] = string(content)
+		}
+		assert.Equal(t, 4, len(contents))
+		urls := map[string]int{}
+		for _, content := range contents {
+			urls[content]++
+		}
+		assert.Equal(t, map[string]int{file.URL: 2, other.URL: 2}, urls)
+	})
+
+	t.Run("SizeLimit", func(t *testing.T) {
+		// The file is larger than the backend says it is
+		qs.MesgQ <- &message.Message{
+			Text:      "see attached",
+			User:      "U234567",
+			ChannelId: "C345678",
+			Files:     []message.File{file},
+		}
+		assert.Equal(t, "see attached", expectResponse(t, qs).Text)
+		params := fileParams(t, expectResponse(t, qs).Text)
+		assert.Equal(t, "", params.Get("path"))
+
+		files, err := filepath.Glob(filepath.Join(tmpDir, "botmand-smallbot-*", "*"))
+		assert.Nil(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+func TestSlowDownload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Setenv("TMPDIR", t.TempDir())
+
+	b := slowBackend{release: make(chan struct{})}
+	cm, qs := newTestManagerWithBackend(ctx, t, map[string]string{
+		"filebot": "handler: cat\ndownload-files: true\ndirect-message-triggers-only: false\n" +
+			"event-prefix: 'file:'\nchannels: [C234567]\n",
+		"echobot": "handler: cat\ndirect-message-triggers-only: false\nchannels: [C345678]\n",
+	}, b)
+	go cm.Start(ctx)
+
+	qs.MesgQ <- &message.Message{
+		Text:      "see attached",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Files:     []message.File{{Name: "app.log", Size: 5, URL: "https://files.example.com/app.log"}},
+	}
+	qs.MesgQ <- &message.Message{Text: "and then", User: "U234567", ChannelId: "C234567"}
+
+	// Other conversations carry on while the file downloads
+	qs.MesgQ <- &message.Message{Text: "hello", User: "U234567", ChannelId: "C345678"}
+	assert.Equal(t, "hello", expectResponse(t, qs).Text)
+
+	select {
+	case m := <-qs.RespQ:
+		assert.Fail(t, "Bot received input before download", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The bot's input stays in order
+	close(b.release)
+	assert.Equal(t, "see attached", expectResponse(t, qs).Text)
+	assert.NotEqual(t, "", fileParams(t, expectResponse(t, qs).Text).Get("path"))
+	assert.Equal(t, "and then", expectResponse(t, qs).Text)
+}
@@ -0,0 +1,98 @@
+package conversation
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Output framing modes
+const (
+	FramingLine       = "line"
+	FramingBlankLine  = "blank-line"
+	FramingTerminator = "terminator"
+)
+
+// Check if a bot's messages are single lines, which need "\n" escapes for
+// newlines
+func lineFraming(framing string) bool {
+	return framing != FramingBlankLine && framing != FramingTerminator
+}
+
+// Read bot output from scanner and pass each complete message to out.
+//
+// In "line" mode, every line is a message. In "blank-line" mode, a message
+// is a run of lines ended by an empty line. In "terminator" mode, a message
+// is a run of lines ended by a line consisting only of the terminator.
+// Any partial message pending when the output ends is flushed.
+func readFrames(scanner *bufio.Scanner, framing string, terminator string, out func(string)) error {
+	var frame []string
+	flush := func() {
+		if len(frame) > 0 {
+			out(strings.Join(frame, "\n"))
+			frame = nil
+		}
+	}
+
+	for scanner.Scan() {
+		t := scanner.Text()
+		switch framing {
+		case FramingBlankLine:
+			if t == "" {
+				flush()
+				continue
+			}
+		case FramingTerminator:
+			if t == terminator {
+				flush()
+				continue
+			}
+		default:
+			out(t)
+			continue
+		}
+		frame = append(frame, t)
+	}
+	flush()
+
+	return scanner.Err()
+}
+
+// Return a scanner which reads lines of up to maxLineSize bytes. Longer lines
+// are returned in chunks of at most maxLineSize bytes instead of making the
+// scanner give up.
+func newLineScanner(r io.Reader, maxLineSize int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if maxLineSize < 1 {
+		maxLineSize = bufio.MaxScanTokenSize
+	}
+	initialSize := bufio.MaxScanTokenSize
+	if maxLineSize < initialSize {
+		initialSize = maxLineSize
+	}
+	scanner.Buffer(make([]byte, 0, initialSize), maxLineSize)
+
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && err == nil && len(data) >= maxLineSize {
+			// Line too long; break it, taking care not to split a rune
+			n := maxLineSize
+			for i := 1; i < utf8.UTFMax && i < n; i++ {
+				if utf8.RuneStart(data[n-i]) {
+					if !utf8.FullRune(data[n-i : n]) {
+						n -= i
+					}
+					break
+				}
+			}
+			logrus.Warnf("Splitting output line longer than %d bytes", maxLineSize)
+			return n, data[:n], nil
+		}
+		return advance, token, err
+	})
+
+	return scanner
+}
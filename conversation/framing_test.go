@@ -0,0 +1,62 @@
+package conversation
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		framing    string
+		terminator string
+		input      string
+		expected   []string
+	}{
+		{
+			name:     "Line",
+			framing:  FramingLine,
+			input:    "one\ntwo\n\nthree\n",
+			expected: []string{"one", "two", "", "three"},
+		},
+		{
+			name:     "BlankLine",
+			framing:  FramingBlankLine,
+			input:    "one\ntwo\n\n\nthree\n```\ncode\n```\n\nfour",
+			expected: []string{"one\ntwo", "three\n```\ncode\n```", "four"},
+		},
+		{
+			name:       "Terminator",
+			framing:    FramingTerminator,
+			terminator: ".",
+			input:      "one\n\ntwo\n.\nthree\n.\n",
+			expected:   []string{"one\n\ntwo", "three"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			scanner := bufio.NewScanner(strings.NewReader(test.input))
+			readFrames(scanner, test.framing, test.terminator, func(s string) {
+				got = append(got, s)
+			})
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	scanner := newLineScanner(strings.NewReader("short\n"+long+"\nend\n"), 40)
+
+	got := []string{}
+	err := readFrames(scanner, FramingLine, "", func(s string) {
+		got = append(got, s)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"short", long[:40], long[40:80], long[80:], "end"}, got)
+}
@@ -0,0 +1,119 @@
+package conversation
+
+import "sync"
+
+// Number of message timestamps remembered per conversation
+const historySize = 1000
+
+// messageHistory tracks the timestamps of messages seen in a conversation,
+// both from users and from the bot, so that events referring to those
+// messages can be routed back to the conversation.
+type messageHistory struct {
+	lock       *sync.Mutex
+	timestamps map[string]bool
+	order      []string
+	lastUser   string
+	lastPosted string
+
+	// User who sent the last user message
+	lastSpeaker string
+
+	// Labels given to messages posted by the bot
+	refs map[string]string
+}
+
+func newMessageHistory() *messageHistory {
+	return &messageHistory{
+		lock:       &sync.Mutex{},
+		timestamps: make(map[string]bool),
+		refs:       make(map[string]string),
+	}
+}
+
+func (h *messageHistory) add(timestamp string) {
+	if timestamp == "" || h.timestamps[timestamp] {
+		return
+	}
+	h.timestamps[timestamp] = true
+	h.order = append(h.order, timestamp)
+	if len(h.order) > historySize {
+		delete(h.timestamps, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// Record a message from a user
+func (h *messageHistory) addUser(timestamp string, user string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.add(timestamp)
+	if timestamp != "" {
+		h.lastUser = timestamp
+	}
+	if user != "" {
+		h.lastSpeaker = user
+	}
+}
+
+// Record a message posted by the bot, labelling it with ref if set
+func (h *messageHistory) addPosted(timestamp string, ref string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.add(timestamp)
+	if timestamp != "" {
+		h.lastPosted = timestamp
+		if ref != "" {
+			h.refs[ref] = timestamp
+		}
+	}
+}
+
+// Return the timestamp of the bot message with the given label, or of the
+// last message posted by the bot if the label is "last"
+func (h *messageHistory) ref(ref string) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if ref == "last" {
+		return h.lastPosted
+	}
+	return h.refs[ref]
+}
+
+// Forget a deleted message
+func (h *messageHistory) remove(timestamp string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for ref, ts := range h.refs {
+		if ts == timestamp {
+			delete(h.refs, ref)
+		}
+	}
+	if h.lastPosted == timestamp {
+		h.lastPosted = ""
+	}
+}
+
+func (h *messageHistory) has(timestamp string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.timestamps[timestamp]
+}
+
+func (h *messageHistory) lastUserMessage() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.lastUser
+}
+
+func (h *messageHistory) lastUserId() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.lastSpeaker
+}
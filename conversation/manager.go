@@ -2,9 +2,13 @@ package conversation
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,22 +16,37 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"github.com/venkytv/botmand/backend"
+	"github.com/venkytv/botmand/cron"
 	"github.com/venkytv/botmand/engine"
 	"github.com/venkytv/botmand/globals"
 	"github.com/venkytv/botmand/message"
 )
 
 type Manager struct {
+	// Context conversations not started by messages run under. Unlike the
+	// schedules' context, it isn't cancelled when engines are reloaded.
+	ctx context.Context
+
 	registry             engine.EngineRegistry
 	backend              backend.Backender
 	backendQueues        backend.BackendQueues
-	triggers             map[*regexp.Regexp][]engine.EngineFactoryer
+	triggers             []trigger
+	slashCommands        map[string][]engine.EngineFactoryer
+	bots                 map[string]engine.EngineFactoryer
+	joinHandlers         []engine.EngineFactoryer
+	webhooks             map[string]webhookBot
+	schedules            []*scheduledJob
+	stopSchedules        context.CancelFunc
+	clock                cron.Clock
 	triggerLock          *sync.RWMutex
-	conversations        map[string]*Conversation
+	conversations        map[string]map[string]*Conversation
 	convLock             *sync.RWMutex
 	channelConversations map[string]map[string]*Conversation
 	channelConvLock      *sync.RWMutex
 
+	// Set if triggers need the names of message senders looked up
+	senderNames bool
+
 	commandRegex *regexp.Regexp
 }
 
@@ -37,16 +56,18 @@ func NewManager(ctx context.Context, cfg *cli.Context, backend backend.Backender
 	engineRegistry.Register("executable", engine.ExecEngineFactoryLoader{})
 
 	cm := Manager{
+		ctx:                  ctx,
 		registry:             engineRegistry,
 		backend:              backend,
 		backendQueues:        backendQueues,
 		triggerLock:          &sync.RWMutex{},
-		conversations:        make(map[string]*Conversation),
+		conversations:        make(map[string]map[string]*Conversation),
 		convLock:             &sync.RWMutex{},
 		channelConversations: make(map[string]map[string]*Conversation),
 		channelConvLock:      &sync.RWMutex{},
+		clock:                cron.RealClock{},
 
-		commandRegex: regexp.MustCompile(fmt.Sprintf(`\b%s(.+)\b`, globals.BotUrlScheme)),
+		commandRegex: regexp.MustCompile(fmt.Sprintf(`\b%s(\S+)`, globals.BotUrlScheme)),
 	}
 
 	engine.ConfigInit()
@@ -71,10 +92,16 @@ func (cm *Manager) LoadEngines(ctx context.Context, cfg *cli.Context) {
 	}
 	config_files = append(config_files, yml_config_files...)
 
-	// Lock the triggers map
+	// Lock the triggers
 	cm.triggerLock.Lock()
 
-	cm.triggers = make(map[*regexp.Regexp][]engine.EngineFactoryer)
+	cm.triggers = nil
+	cm.senderNames = false
+	cm.slashCommands = make(map[string][]engine.EngineFactoryer)
+	cm.bots = make(map[string]engine.EngineFactoryer)
+	cm.joinHandlers = nil
+	cm.webhooks = make(map[string]webhookBot)
+	cm.schedules = nil
 	execEngineNames := make(map[string]bool)
 	for _, config_file := range config_files {
 		logrus.Debugf("Loading config file: %s", config_file)
@@ -98,22 +125,73 @@ func (cm *Manager) LoadEngines(ctx context.Context, cfg *cli.Context) {
 		logrus.Debugf("Loaded engine factory: %#v", factory)
 
 		execEngineNames[config.Name] = true
+		cm.bots[config.Name] = factory
 		logrus.Infof("Loaded bot: %s", config.Name)
 
 		// Add triggers from config to the manager
-		for _, pattern := range config.Triggers {
-			re, err := regexp.Compile(pattern)
+		for _, tc := range config.Triggers {
+			t, err := newTrigger(tc, factory)
 			if err != nil {
-				logrus.Warnf("Failed to compile regex: %s: %#v: %v", pattern, factory, err)
+				logrus.Warnf("Failed to load trigger: %s: %#v: %v", tc.Pattern, factory, err)
 				continue
 			}
 
-			cm.triggers[re] = append(cm.triggers[re], factory)
+			cm.triggers = append(cm.triggers, t)
+
+			// Triggers can list users by account name
+			cm.senderNames = cm.senderNames || len(tc.Users) > 0
+		}
+
+		for _, command := range config.SlashCommands {
+			command = "/" + strings.TrimPrefix(command, "/")
+			cm.slashCommands[command] = append(cm.slashCommands[command], factory)
+		}
+
+		if config.OnJoin.Message != "" || config.OnJoin.Start {
+			cm.joinHandlers = append(cm.joinHandlers, factory)
+		}
+
+		if secret, err := webhookSecret(config); err != nil {
+			logrus.Warnf("Failed to read webhook secret: %s: %v", config.Name, err)
+		} else if secret != "" {
+			cm.webhooks[config.Name] = webhookBot{ef: factory, secret: secret}
+		}
+
+		for _, entry := range config.Schedule {
+			schedule, err := cron.Parse(entry.Cron)
+			if err != nil {
+				logrus.Warnf("Failed to parse schedule: %s: %v", config.Name, err)
+				continue
+			}
+			cm.schedules = append(cm.schedules, &scheduledJob{
+				ef:       factory,
+				config:   entry,
+				schedule: schedule,
+				last:     make(map[string]*Conversation),
+			})
 		}
 	}
 
+	// Try triggers of higher priority bots first, and bots of the same
+	// priority in order of name, so that a message always starts the same
+	// bots regardless of the order config files were loaded in
+	sort.SliceStable(cm.triggers, func(i, j int) bool {
+		a, b := cm.triggers[i].ef.Config(), cm.triggers[j].ef.Config()
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Name < b.Name
+	})
+
+	// Schedules already running are restarted on reload
+	restartSchedules := cm.stopSchedules != nil
+
 	cm.triggerLock.Unlock()
 
+	if restartSchedules {
+		cm.startSchedules(ctx)
+	}
+
 	globals.NumExecEngineFactories.Set(float64(len(execEngineNames)))
 	nTriggers := len(cm.triggers)
 	globals.NumConversationTriggers.Set(float64(nTriggers))
@@ -126,13 +204,33 @@ func (cm *Manager) LoadEngines(ctx context.Context, cfg *cli.Context) {
 func (cm *Manager) Start(ctx context.Context) {
 	go cm.backend.Read()
 	go cm.backend.Post()
+	cm.startSchedules(ctx)
 
 	for {
 		select {
 		case m := <-cm.backendQueues.MesgQ:
-			m = cm.backend.Sanitize(m)
+			// Only look up senders' names if triggers need them, as
+			// lookups hold up every conversation
+			cm.triggerLock.RLock()
+			senderNames := cm.senderNames
+			cm.triggerLock.RUnlock()
+			m = cm.backend.Sanitize(m, message.SanitizeOptions{Users: senderNames})
 
-			convs := cm.GetConversations(ctx, m)
+			var convs []*Conversation
+			switch m.Event {
+			case message.EventMessage:
+				convs = cm.GetConversations(ctx, m)
+			case message.EventSlashCommand:
+				convs = cm.GetSlashCommandConversations(ctx, m)
+			case message.EventChannelJoined:
+				cm.JoinChannel(ctx, m)
+			case message.EventWebhook:
+				convs = cm.GetWebhookConversations(ctx, m)
+			case message.EventReactionAdded:
+				convs = cm.GetReactionConversations(ctx, m)
+			default:
+				convs = cm.GetEventConversations(m)
+			}
 			for _, conv := range convs {
 				conv.Post(m)
 			}
@@ -150,6 +248,7 @@ func (cm *Manager) getEngineEnvironment(m *message.Message, env map[string]strin
 	envmap[prefix+"_USER_NAME"] = m.BotUserName
 	envmap[prefix+"_CHANNEL"] = m.ChannelName
 	envmap[prefix+"_CHANNEL_ID"] = m.ChannelId
+	envmap[prefix+"_CHANNEL_TYPE"] = m.ChannelType
 	envmap[prefix+"_BACKEND_NAME"] = cm.backend.Name()
 	envmap[prefix+"_LOCALE"] = m.Locale
 
@@ -157,6 +256,28 @@ func (cm *Manager) getEngineEnvironment(m *message.Message, env map[string]strin
 		envmap[prefix+"_THREAD"] = m.ThreadId
 	}
 
+	if m.Schedule != "" {
+		envmap[prefix+"_SCHEDULE"] = m.Schedule
+		envmap[prefix+"_SCHEDULED_RUN"] = m.ScheduledRun.Format(time.RFC3339)
+	}
+
+	if m.HandoffFrom != "" {
+		envmap[prefix+"_HANDOFF_FROM"] = m.HandoffFrom
+	}
+
+	for name, value := range m.Matches {
+		envmap[prefix+"_MATCH_"+strings.ToUpper(name)] = value
+	}
+
+	if m.Event == message.EventReactionAdded {
+		envmap[prefix+"_REACTION"] = m.Reaction
+	}
+
+	if m.Command != "" {
+		envmap[prefix+"_SLASH_COMMAND"] = m.Command
+		envmap[prefix+"_RESPONSE_URL"] = m.ResponseURL
+	}
+
 	for k, v := range env {
 		envmap[k] = v
 	}
@@ -165,29 +286,72 @@ func (cm *Manager) getEngineEnvironment(m *message.Message, env map[string]strin
 }
 
 func (cm *Manager) cleanupConversation(c *Conversation) {
-	// Remove conversation from manager
-	if c.conversationType == ConversationTypeThreaded {
-		cm.convLock.Lock()
-		delete(cm.conversations, c.threadId)
-		globals.NumThreadedConversations.Dec()
-		globals.NumConversations.Dec()
-		cm.convLock.Unlock()
-	} else {
-		cm.channelConvLock.Lock()
-		delete(cm.channelConversations[c.channelId], c.engineName)
-		globals.NumChannelConversations.Dec()
-		globals.NumConversations.Dec()
-		cm.channelConvLock.Unlock()
+	c.removeScratchDir()
+	cm.endConversation(c)
+}
+
+// Remove a conversation from the manager, so that it receives no more
+// messages. Conversations can be ended by the bot before its process exits,
+// so this only takes effect once.
+func (cm *Manager) endConversation(c *Conversation) {
+	c.endOnce.Do(func() {
+		if c.conversationType == ConversationTypeThreaded {
+			cm.convLock.Lock()
+			cm.deleteThreadConversation(c.threadId, c)
+			globals.NumThreadedConversations.Dec()
+			globals.NumConversations.Dec()
+			cm.convLock.Unlock()
+		} else {
+			cm.channelConvLock.Lock()
+			if cm.channelConversations[c.channelId][c.engineName] == c {
+				delete(cm.channelConversations[c.channelId], c.engineName)
+			}
+			globals.NumChannelConversations.Dec()
+			globals.NumConversations.Dec()
+			cm.channelConvLock.Unlock()
+		}
+		close(c.done)
+	})
+}
+
+// Add a conversation to a thread, unless the bot already has one there.
+// Must be called with convLock held.
+func (cm *Manager) setThreadConversation(threadId string, c *Conversation) bool {
+	if _, exists := cm.conversations[threadId][c.engineName]; exists {
+		return false
+	}
+	if _, exists := cm.conversations[threadId]; !exists {
+		cm.conversations[threadId] = map[string]*Conversation{}
 	}
+	cm.conversations[threadId][c.engineName] = c
+	return true
+}
+
+// Remove a conversation from a thread. Must be called with convLock held.
+func (cm *Manager) deleteThreadConversation(threadId string, c *Conversation) {
+	if cm.conversations[threadId][c.engineName] != c {
+		return
+	}
+	delete(cm.conversations[threadId], c.engineName)
+	if len(cm.conversations[threadId]) == 0 {
+		delete(cm.conversations, threadId)
+	}
+}
+
+// Look up a bot's conversation in a thread
+func (cm *Manager) threadConversation(threadId string, bot string) *Conversation {
+	cm.convLock.RLock()
+	defer cm.convLock.RUnlock()
+
+	return cm.conversations[threadId][bot]
 }
 
-func (cm *Manager) addThreadedConversation(ctx context.Context, c *Conversation, threadId string) {
+func (cm *Manager) addThreadedConversation(ctx context.Context, c *Conversation, threadId string) bool {
 	c.threadId = threadId
 	c.conversationType = ConversationTypeThreaded
 
 	cm.convLock.Lock()
-	if _, exists := cm.conversations[threadId]; !exists {
-		cm.conversations[threadId] = c
+	if cm.setThreadConversation(threadId, c) {
 		globals.NumThreadedConversations.Inc()
 		globals.NumConversations.Inc()
 		cm.convLock.Unlock()
@@ -196,17 +360,42 @@ func (cm *Manager) addThreadedConversation(ctx context.Context, c *Conversation,
 			c.Start(ctx)
 			cm.cleanupConversation(c)
 		}()
+
+		return true
 	} else {
 		cm.convLock.Unlock()
 		logrus.Infof("Race detected: conversation: %#v, thread: %s", c, threadId)
+		c.removeScratchDir()
+		return false
 	}
 }
 
-func (cm *Manager) addChannelConversation(ctx context.Context, c *Conversation, channelId string) bool {
+// Start a threaded conversation whose thread doesn't exist yet. The thread is
+// started by the first message the bot posts, unless the conversation only
+// responds to the user who started it.
+func (cm *Manager) addPendingConversation(ctx context.Context, c *Conversation) {
+	c.conversationType = ConversationTypeThreaded
+	c.pendingThread = c.responseURL == ""
+
+	cm.convLock.Lock()
+	globals.NumThreadedConversations.Inc()
+	globals.NumConversations.Inc()
+	cm.convLock.Unlock()
+
+	go func() {
+		c.Start(ctx)
+		cm.cleanupConversation(c)
+	}()
+}
+
+// Add a channel conversation, unless the bot is already active in the
+// channel. Returns the bot's conversation in the channel, which is the
+// existing one if the conversation wasn't added.
+func (cm *Manager) addChannelConversation(ctx context.Context, c *Conversation, channelId string) (*Conversation, bool) {
 	c.conversationType = ConversationTypeChannel
 
 	cm.channelConvLock.Lock()
-	if _, exists := cm.channelConversations[channelId][c.engineName]; !exists {
+	if existing, exists := cm.channelConversations[channelId][c.engineName]; !exists {
 		if _, exists := cm.channelConversations[channelId]; !exists {
 			cm.channelConversations[channelId] = map[string]*Conversation{}
 		}
@@ -220,20 +409,110 @@ func (cm *Manager) addChannelConversation(ctx context.Context, c *Conversation,
 			cm.cleanupConversation(c)
 		}()
 
-		return true
+		return c, true
 	} else {
 		// Bot already active in channel
 		cm.channelConvLock.Unlock()
-		return false
+		c.removeScratchDir()
+		return existing, false
+	}
+}
+
+// Check if a bot is allowed to start conversations in the message's channel
+func inChannels(config *engine.Config, m *message.Message) bool {
+	// Bots can be allowed or barred from direct message channels outright.
+	// Otherwise bots limited to some channels can't be started in them.
+	if config.AllowIM != nil && (m.ChannelType == message.ChannelTypeIM || m.ChannelType == message.ChannelTypeMpIM) {
+		return *config.AllowIM
+	}
+	if len(config.Channels) < 1 {
+		return true
+	}
+	for _, channel := range config.Channels {
+		// Channels can be listed by name or by ID. IDs don't change when
+		// channels are renamed.
+		if channel == m.ChannelName || channel == m.ChannelId {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a conversation with a bot, prompted by a message
+func (cm *Manager) newConversation(ef engine.EngineFactoryer, m *message.Message) *Conversation {
+	config := ef.Config()
+
+	engqs := engine.NewEngineQueues()
+	envmap := cm.getEngineEnvironment(m, config.Environment)
+
+	if config.UploadDirectory != "" {
+		envmap[strings.ToUpper(globals.BotName)+"_UPLOAD_DIR"] = config.UploadDirectory
+	}
+
+	scratchDir := ""
+	if config.DownloadFiles {
+		dir, err := os.MkdirTemp("", globals.BotName+"-"+config.Name+"-")
+		if err != nil {
+			logrus.Errorf("Failed to create scratch directory for %s: %v", config.Name, err)
+		} else {
+			scratchDir = dir
+			envmap[strings.ToUpper(globals.BotName)+"_SCRATCH_DIR"] = scratchDir
+		}
+	}
+
+	e := ef.Create(envmap)
+
+	return &Conversation{
+		channelId:          m.ChannelId,
+		channelName:        m.ChannelName,
+		manager:            cm,
+		engine:             e,
+		engineName:         config.Name,
+		engineQueues:       engqs,
+		prefixUsername:     config.PrefixUsername,
+		directMessagesOnly: config.DirectMessagesOnly,
+		outputFraming:      config.OutputFraming,
+		outputTerminator:   config.OutputTerminator,
+		maxLineSize:        config.MaxLineSize,
+		uploadMaxSize:      config.UploadMaxSize,
+		uploadDir:          config.UploadDirectory,
+		removeUploads:      config.RemoveUploads,
+		deliverFiles:       config.Files || config.DownloadFiles,
+		downloadMaxSize:    config.DownloadMaxSize,
+		deliverReactions:   config.Reactions,
+		deliverEdits:       config.Edits,
+		eventPrefix:        config.EventPrefix,
+		expandMentions:     config.ExpandMentions,
+		postChannels:       config.PostChannels,
+		exclusive:          config.Exclusive,
+		handoffTo:          config.HandoffTo,
+		origin:             *m,
+		sanitize: message.SanitizeOptions{
+			// Senders are prefixed to messages by display name
+			Users:    config.PrefixUsername && config.SanitizeMentions,
+			Mentions: config.SanitizeMentions,
+			Links:    config.SanitizeLinks,
+			Entities: config.SanitizeEntities,
+		},
+		scratchDir: scratchDir,
+		history:    newMessageHistory(),
+		done:       make(chan struct{}),
+		stdinDone:  make(chan struct{}),
 	}
 }
 
 func (cm *Manager) GetConversations(ctx context.Context, m *message.Message) []*Conversation {
 	conversations := []*Conversation{}
 
+	// Bots with conversations in the message thread, and whether any of
+	// them need the thread to themselves
+	inThread := map[string]bool{}
+	exclusive := false
+
 	cm.convLock.RLock()
-	if c, ok := cm.conversations[m.ThreadId]; ok {
-		// Found conversation for message thread
+	for _, c := range cm.conversations[m.ThreadId] {
+		inThread[c.engineName] = true
+		exclusive = exclusive || c.exclusive
 		if c.directMessagesOnly && !m.DirectMessage {
 			logrus.Debugf("Conversation is direct messages only, ignoring message: %#v", c)
 		} else {
@@ -242,14 +521,9 @@ func (cm *Manager) GetConversations(ctx context.Context, m *message.Message) []*
 		}
 	}
 	cm.convLock.RUnlock()
+	activeThread := len(inThread) > 0
 
-	// Can't have multple bot conversations in a thread
-	// XXX: Or should we allow this?
-	if len(conversations) > 0 {
-		return conversations
-	}
-
-	if !m.InThread {
+	if !activeThread && !m.InThread {
 		cm.channelConvLock.RLock()
 		if cc, ok := cm.channelConversations[m.ChannelId]; ok {
 			// Found channel conversations for channel ID
@@ -265,64 +539,90 @@ func (cm *Manager) GetConversations(ctx context.Context, m *message.Message) []*
 		cm.channelConvLock.RUnlock()
 	}
 
+	// Bots whose triggers have matched the message
+	matched := map[string]bool{}
+
 	cm.triggerLock.RLock()
-	for re, efs := range cm.triggers {
-		if re.MatchString(m.Text) {
-			for _, ef := range efs {
-				config := ef.Config()
-
-				// Respond only to direct messages unless trigger is global
-				if config.DirectMessageTriggersOnly && !m.DirectMessage {
-					logrus.Debugf("Skipping %s trigger for non-direct message", config.Name)
-					continue
-				}
 
-				// If list of channels is specified, only create conversation
-				// if channel is in list
-				if len(config.Channels) > 0 {
-					found := false
-					for _, channel := range config.Channels {
-						if channel == m.ChannelName {
-							found = true
-							break
-						}
-					}
-					if !found {
-						logrus.Debugf("Skipping %s trigger for channel %s", config.Name, m.ChannelName)
-						continue
-					}
-				}
+	// Triggers are tried in priority order, and fallback bots only if no
+	// other bot has taken the message
+	for _, fallback := range []bool{false, true} {
+		if fallback && (len(conversations) > 0 || len(matched) > 0) {
+			break
+		}
 
-				engqs := engine.NewEngineQueues()
-				envmap := cm.getEngineEnvironment(m, config.Environment)
+		for _, t := range cm.triggers {
+			config := t.ef.Config()
+			if config.Fallback != fallback || matched[config.Name] {
+				continue
+			}
+			captures, ok := cm.matchTrigger(t, m)
+			if !ok {
+				continue
+			}
 
-				e := ef.Create(envmap)
+			// Respond only to direct messages unless trigger is global
+			if config.DirectMessageTriggersOnly && !m.DirectMessage {
+				logrus.Debugf("Skipping %s trigger for non-direct message", config.Name)
+				continue
+			}
 
-				c := Conversation{
-					channelId:          m.ChannelId,
-					channelName:        m.ChannelName,
-					manager:            cm,
-					engine:             e,
-					engineName:         config.Name,
-					engineQueues:       engqs,
-					prefixUsername:     config.PrefixUsername,
-					directMessagesOnly: config.DirectMessagesOnly,
+			// If list of channels is specified, only create conversation
+			// if channel is in list
+			if !inChannels(config, m) {
+				logrus.Debugf("Skipping %s trigger for channel %s", config.Name, m.ChannelName)
+				continue
+			}
+
+			// Threaded bots can join other bots in a thread, unless
+			// either needs the thread to itself
+			if activeThread && !config.Threaded {
+				logrus.Debugf("Skipping %s trigger in thread with active conversation", config.Name)
+				continue
+			}
+			if config.Threaded && len(inThread) > 0 {
+				if inThread[config.Name] {
+					// Bots already in the thread still stop lower priority
+					// bots joining, as they would have on starting it
+					if config.StopOnMatch {
+						logrus.Debugf("Not trying triggers after %s: stop-on-match", config.Name)
+						break
+					}
+					continue
+				}
+				if exclusive || config.Exclusive {
+					logrus.Debugf("Skipping %s trigger in thread with other bots: exclusive", config.Name)
+					continue
 				}
+			}
+
+			matched[config.Name] = true
 
-				if config.Threaded {
-					cm.addThreadedConversation(ctx, &c, m.ThreadId)
-					conversations = append(conversations, &c)
+			// Each bot sees what its own trigger matched
+			tm := *m
+			tm.Matches = captures
+			c := cm.newConversation(t.ef, &tm)
+
+			if config.Threaded {
+				if cm.addThreadedConversation(ctx, c, m.ThreadId) {
+					conversations = append(conversations, c)
+					inThread[config.Name] = true
+					exclusive = exclusive || config.Exclusive
 					logrus.Debugf("New threaded conversation with %s: %+v", config.Name, c)
+				}
+			} else {
+				if _, added := cm.addChannelConversation(ctx, c, m.ChannelId); added {
+					conversations = append(conversations, c)
+					logrus.Debugf("New channel conversation with %s: %+v", c.engineName, c)
 				} else {
-					if cm.addChannelConversation(ctx, &c, m.ChannelId) {
-						conversations = append(conversations, &c)
-						logrus.Debugf("New channel conversation with %s: %+v", c.engineName, c)
-					} else {
-						logrus.Debugf("Ignoring trigger as bot already active: %s: channel='%s' msg='%s' trigger='%s'",
-							c.engineName, c.channelName, m.Text, re.String())
-					}
+					logrus.Debugf("Ignoring trigger as bot already active: %s: channel='%s' msg='%s' trigger='%s'",
+						c.engineName, c.channelName, m.Text, t.re.String())
 				}
+			}
 
+			if config.StopOnMatch {
+				logrus.Debugf("Not trying triggers after %s: stop-on-match", config.Name)
+				break
 			}
 		}
 	}
@@ -333,66 +633,564 @@ func (cm *Manager) GetConversations(ctx context.Context, m *message.Message) []*
 	return conversations
 }
 
+// Greet the channel botmand has been invited to, and start conversations
+// with bots configured to start on joining
+func (cm *Manager) JoinChannel(ctx context.Context, m *message.Message) {
+	cm.triggerLock.RLock()
+	efs := cm.joinHandlers
+	cm.triggerLock.RUnlock()
+
+	for _, ef := range efs {
+		config := ef.Config()
+		if m.ChannelType == message.ChannelTypeIM || m.ChannelType == message.ChannelTypeMpIM || !inChannels(config, m) {
+			logrus.Debugf("Skipping %s on joining channel %s", config.Name, m.ChannelName)
+			continue
+		}
+
+		if config.OnJoin.Message != "" {
+			cm.post(&message.Message{
+				ChannelId:      m.ChannelId,
+				Text:           config.OnJoin.Message,
+				ExpandMentions: config.ExpandMentions,
+			})
+		}
+
+		if !config.OnJoin.Start {
+			continue
+		}
+
+		c := cm.newConversation(ef, m)
+		if config.Threaded {
+			// The bot's first message starts its thread
+			cm.addPendingConversation(ctx, c)
+			logrus.Debugf("New threaded conversation with %s on joining channel: %+v", config.Name, c)
+		} else if _, added := cm.addChannelConversation(ctx, c, m.ChannelId); added {
+			logrus.Debugf("New channel conversation with %s on joining channel: %+v", config.Name, c)
+		}
+	}
+}
+
+// GetSlashCommandConversations starts conversations with the bots handling a
+// slash command. The text of the command is the first message of the
+// conversation.
+func (cm *Manager) GetSlashCommandConversations(ctx context.Context, m *message.Message) []*Conversation {
+	conversations := []*Conversation{}
+
+	cm.triggerLock.RLock()
+	efs := cm.slashCommands[m.Command]
+	cm.triggerLock.RUnlock()
+
+	for _, ef := range efs {
+		config := ef.Config()
+		if !inChannels(config, m) {
+			logrus.Debugf("Skipping %s slash command for channel %s", config.Name, m.ChannelName)
+			continue
+		}
+
+		c := cm.newConversation(ef, m)
+
+		switch {
+		case config.SlashCommandEphemeral:
+			c.responseURL = m.ResponseURL
+			cm.addPendingConversation(ctx, c)
+			conversations = append(conversations, c)
+			logrus.Debugf("New ephemeral conversation with %s: %+v", config.Name, c)
+
+		case config.Threaded:
+			cm.addPendingConversation(ctx, c)
+			conversations = append(conversations, c)
+			logrus.Debugf("New threaded conversation with %s: %+v", config.Name, c)
+
+		default:
+			// Pass the command on to the bot if already active in the
+			// channel
+			c, added := cm.addChannelConversation(ctx, c, m.ChannelId)
+			conversations = append(conversations, c)
+			if added {
+				logrus.Debugf("New channel conversation with %s: %+v", config.Name, c)
+			}
+		}
+	}
+
+	if len(efs) == 0 {
+		logrus.Warnf("No bot found for slash command: %s", m.Command)
+	}
+
+	return conversations
+}
+
+// GetEventConversations returns the conversations an event about an earlier
+// message, such as a reaction or an edit, should be delivered to
+func (cm *Manager) GetEventConversations(m *message.Message) []*Conversation {
+	conversations := []*Conversation{}
+
+	// Look for the threaded conversation owning the thread the message is
+	// in, or which the message started
+	threadId := m.ThreadId
+	if threadId == "" {
+		threadId = m.Timestamp
+	}
+
+	cm.convLock.RLock()
+	thread := cm.conversations[threadId]
+	for _, c := range thread {
+		// Bots sharing a thread only get events on messages they have seen
+		// or posted, so that, e.g., block actions go back to the bot which
+		// posted the blocks
+		if c.channelId == m.ChannelId && (len(thread) == 1 || c.history.has(m.Timestamp)) {
+			conversations = append(conversations, c)
+		}
+	}
+	if len(conversations) == 0 {
+		for _, tc := range cm.conversations {
+			for _, c := range tc {
+				if c.channelId == m.ChannelId && c.history.has(m.Timestamp) {
+					conversations = append(conversations, c)
+				}
+			}
+		}
+	}
+	cm.convLock.RUnlock()
+
+	cm.channelConvLock.RLock()
+	for _, c := range cm.channelConversations[m.ChannelId] {
+		if c.history.has(m.Timestamp) {
+			conversations = append(conversations, c)
+		}
+	}
+	cm.channelConvLock.RUnlock()
+
+	logrus.Debugf("Found %d conversations for event on message %s", len(conversations), m.Timestamp)
+
+	return conversations
+}
+
+// Find the conversations a reaction added to a message is delivered to, and
+// start bots with triggers matching the reaction
+func (cm *Manager) GetReactionConversations(ctx context.Context, m *message.Message) []*Conversation {
+	conversations := cm.GetEventConversations(m)
+
+	// Bots the reaction is already delivered to
+	active := map[string]bool{}
+	for _, c := range conversations {
+		active[c.engineName] = true
+	}
+
+	cm.triggerLock.RLock()
+	defer cm.triggerLock.RUnlock()
+
+	for _, t := range cm.triggers {
+		config := t.ef.Config()
+		if config.Fallback || active[config.Name] {
+			continue
+		}
+		captures, ok := cm.matchTrigger(t, m)
+		if !ok {
+			continue
+		}
+
+		if !inChannels(config, m) {
+			logrus.Debugf("Skipping %s reaction trigger for channel %s", config.Name, m.ChannelName)
+			continue
+		}
+
+		// Threaded bots reply in a thread on the message reacted to,
+		// unless it needs to be left to the bots already there
+		tm := *m
+		tm.Matches = captures
+		if config.Threaded {
+			if cm.threadIsExclusive(m.Timestamp, config.Exclusive) {
+				logrus.Debugf("Skipping %s reaction trigger in thread with other bots: exclusive", config.Name)
+				continue
+			}
+			tm.ThreadId = m.Timestamp
+		}
+
+		active[config.Name] = true
+		c := cm.newConversation(t.ef, &tm)
+
+		if config.Threaded {
+			if cm.addThreadedConversation(ctx, c, tm.ThreadId) {
+				conversations = append(conversations, c)
+				logrus.Debugf("New threaded conversation with %s for reaction: %+v", config.Name, c)
+			}
+		} else if _, added := cm.addChannelConversation(ctx, c, m.ChannelId); added {
+			conversations = append(conversations, c)
+			logrus.Debugf("New channel conversation with %s for reaction: %+v", config.Name, c)
+		}
+
+		if config.StopOnMatch {
+			logrus.Debugf("Not trying triggers after %s: stop-on-match", config.Name)
+			break
+		}
+	}
+
+	return conversations
+}
+
+// Check if a bot can't join a thread because it, or a bot already in the
+// thread, needs the thread to itself
+func (cm *Manager) threadIsExclusive(threadId string, exclusive bool) bool {
+	cm.convLock.RLock()
+	defer cm.convLock.RUnlock()
+
+	for _, c := range cm.conversations[threadId] {
+		if exclusive || c.exclusive {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a message to the backend, once the channel's messages aren't backed up
+func (cm *Manager) post(m *message.Message) {
+	cm.backend.WaitToPost(m.ChannelId)
+	cm.backendQueues.RespQ <- m
+}
+
+// Open a direct message channel with a user and return its ID. The request
+// waits its turn behind messages already queued for the conversation's
+// channel.
+func (cm *Manager) openIM(ctx context.Context, c *Conversation, user string) string {
+	m := &message.Message{
+		ChannelId:     c.channelId,
+		User:          user,
+		Action:        message.ActionOpenIM,
+		ChannelIdChan: make(chan string, 1),
+	}
+	cm.post(m)
+
+	select {
+	case channelId := <-m.ChannelIdChan:
+		if channelId == "" {
+			logrus.Warnf("Failed to open direct message channel: bot=%s user=%s", c.engineName, user)
+		}
+		return channelId
+	case <-ctx.Done():
+		return ""
+	}
+}
+
+// Move a conversation to be a channel conversation in another channel
+func (cm *Manager) moveToChannel(c *Conversation, channelId string) bool {
+	cm.convLock.Lock()
+	cm.channelConvLock.Lock()
+	defer cm.channelConvLock.Unlock()
+	defer cm.convLock.Unlock()
+
+	if _, exists := cm.channelConversations[channelId][c.engineName]; exists {
+		logrus.Warnf("Bot %s already active in channel %s", c.engineName, channelId)
+		return false
+	}
+
+	if c.conversationType == ConversationTypeThreaded {
+		cm.deleteThreadConversation(c.threadId, c)
+		globals.NumThreadedConversations.Dec()
+		globals.NumChannelConversations.Inc()
+	} else {
+		delete(cm.channelConversations[c.channelId], c.engineName)
+	}
+
+	if _, exists := cm.channelConversations[channelId]; !exists {
+		cm.channelConversations[channelId] = map[string]*Conversation{}
+	}
+	cm.channelConversations[channelId][c.engineName] = c
+
+	logrus.Debugf("Moving %s to channel %s", c.engineName, channelId)
+	c.conversationType = ConversationTypeChannel
+	c.channelId = channelId
+	c.channelName = ""
+	c.threadId = ""
+	c.pendingThread = false
+	c.responseURL = ""
+
+	return true
+}
+
 // Conversation commands
 const (
 	_ = iota
 	ConversationCommandSwitchChannel
 	ConversationCommandSwitchThread
+	ConversationCommandUpload
+	ConversationCommandReact
+	ConversationCommandRef
+	ConversationCommandEdit
+	ConversationCommandDelete
+	ConversationCommandBlocks
+	ConversationCommandEphemeral
+	ConversationCommandDM
+	ConversationCommandPost
+	ConversationCommandEnd
+	ConversationCommandHandoff
 )
 
-func (cm *Manager) Post(c *Conversation, m *message.Message) {
+// Parse a botmand:// command of the form "verb[/arg][?params]"
+func parseCommand(s string) (int, string, url.Values) {
+	cmd, query, _ := strings.Cut(s, "?")
+	verb, arg, _ := strings.Cut(cmd, "/")
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		logrus.Warnf("Invalid command parameters: %s: %v", s, err)
+	}
+
+	switch verb {
+	case "switch":
+		switch arg {
+		case "channel":
+			return ConversationCommandSwitchChannel, "", params
+		case "thread":
+			return ConversationCommandSwitchThread, "", params
+		}
+	case "upload":
+		return ConversationCommandUpload, arg, params
+	case "react":
+		if arg != "" {
+			return ConversationCommandReact, arg, params
+		}
+	case "ref":
+		if arg != "" {
+			return ConversationCommandRef, arg, params
+		}
+	case "edit":
+		if arg != "" {
+			return ConversationCommandEdit, arg, params
+		}
+	case "delete":
+		if arg != "" {
+			return ConversationCommandDelete, arg, params
+		}
+	case "blocks":
+		return ConversationCommandBlocks, arg, params
+	case "ephemeral":
+		return ConversationCommandEphemeral, arg, params
+	case "dm":
+		if arg != "" {
+			return ConversationCommandDM, arg, params
+		}
+	case "post":
+		if arg != "" {
+			return ConversationCommandPost, arg, params
+		}
+	case "end":
+		if arg == "" || arg == "close" {
+			return ConversationCommandEnd, arg, params
+		}
+	case "handoff":
+		if arg != "" {
+			return ConversationCommandHandoff, arg, params
+		}
+	}
+
+	return 0, "", nil
+}
+
+func (cm *Manager) Post(ctx context.Context, c *Conversation, m *message.Message) {
 	if len(m.Text) == 0 {
 		logrus.Debugf("Ignoring empty message: %#v", m)
 		return
 	}
 
+	if !c.active() {
+		logrus.Debugf("Conversation with %s has ended, dropping message: %s", c.engineName, m.Text)
+		return
+	}
+
 	logrus.Debugf("Posting message to backend: %#v", m)
 
 	command := 0
+	var arg string
+	var params url.Values
 	if strings.Contains(m.Text, globals.BotUrlScheme) {
 		matches := cm.commandRegex.FindStringSubmatch(m.Text)
 		if len(matches) > 0 {
-			switch matches[1] {
-			case "switch/channel":
-				command = ConversationCommandSwitchChannel
-			case "switch/thread":
-				command = ConversationCommandSwitchThread
-			}
+			command, arg, params = parseCommand(matches[1])
 
 			if command != 0 {
 				logrus.Debugf("Matched command: %s", matches[0])
 
 				// Remove command from message text
 				m.Text = strings.TrimSpace(strings.Replace(m.Text, matches[0], "", 1))
-				if len(m.Text) == 0 {
-					m.Text = "_..._"
-				}
 			} else {
 				logrus.Debugf("Ignoring unknown command in message: %s", m.Text)
 			}
 		}
 	}
 
-	if command == ConversationCommandSwitchThread {
+	switch command {
+	case ConversationCommandSwitchChannel, ConversationCommandSwitchThread:
+		// Typing indicators aren't messages, so can't start threads
+		if len(m.Text) == 0 || m.Text == "..." {
+			m.Text = "_..._"
+		}
+
+	case ConversationCommandUpload:
+		upload, comment, err := c.newUpload(params, m.Text)
+		if err != nil {
+			logrus.Warnf("Failed to upload file for bot %s: %v", c.engineName, err)
+			return
+		}
+		m.Action = message.ActionUpload
+		m.Upload = upload
+		m.Text = comment
+
+	case ConversationCommandReact:
+		// React to the given message, or the last user message
+		timestamp := params.Get("ts")
+		if timestamp == "" {
+			timestamp = c.history.lastUserMessage()
+		}
+		if timestamp == "" {
+			logrus.Warnf("No message for bot %s to react to", c.engineName)
+		} else {
+			cm.post(&message.Message{
+				ChannelId: m.ChannelId,
+				ThreadId:  m.ThreadId,
+				Timestamp: timestamp,
+				Action:    message.ActionReact,
+				Reaction:  strings.Trim(arg, ":"),
+			})
+		}
+		if len(m.Text) == 0 {
+			return
+		}
+
+	case ConversationCommandEdit:
+		if len(m.Text) == 0 {
+			logrus.Warnf("Ignoring empty edit of message %s by bot %s", arg, c.engineName)
+			return
+		}
+		m.Action = message.ActionUpdate
+		m.Target = func() string { return c.history.ref(arg) }
+
+	case ConversationCommandDelete:
+		cm.post(&message.Message{
+			ChannelId: m.ChannelId,
+			ThreadId:  m.ThreadId,
+			Action:    message.ActionDelete,
+			Target:    func() string { return c.history.ref(arg) },
+			Deleted:   c.history.remove,
+		})
+		if len(m.Text) == 0 {
+			return
+		}
+
+	case ConversationCommandBlocks:
+		// The rest of the message is a rich message payload. Use its
+		// fallback text, if any, for backends which can't render it.
+		m.Blocks = []byte(m.Text)
+		var payload struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(m.Blocks, &payload); err == nil && payload.Text != "" {
+			m.Text = payload.Text
+		}
+
+	case ConversationCommandEphemeral:
+		// Post the message only to the given user, or the last speaker
+		if len(m.Text) == 0 {
+			return
+		}
+		user := strings.TrimPrefix(arg, "@")
+		if user == "" {
+			user = c.history.lastUserId()
+		}
+		if user == "" {
+			logrus.Warnf("No user for ephemeral message from bot %s", c.engineName)
+			return
+		}
+		m.Action = message.ActionEphemeral
+		m.User = user
+
+	case ConversationCommandDM:
+		// Move the conversation to a direct message channel with the user
+		channelId := cm.openIM(ctx, c, strings.TrimPrefix(arg, "@"))
+		if channelId == "" || !cm.moveToChannel(c, channelId) {
+			return
+		}
+		m.ChannelId = c.channelId
+		m.ChannelName = c.channelName
+		m.ThreadId = ""
+		if len(m.Text) == 0 {
+			return
+		}
+
+	case ConversationCommandEnd:
+		if len(m.Text) == 0 {
+			cm.end(c, arg)
+			return
+		}
+
+	case ConversationCommandHandoff:
+		// The rest of the message is passed to the next bot, not posted
+		cm.handoff(ctx, c, arg, m.Text)
+		return
+
+	case ConversationCommandPost:
+		// Post the message to another channel, leaving the conversation
+		// where it is
+		channel := strings.TrimPrefix(arg, "#")
+		if !c.canPostTo(channel) {
+			logrus.Warnf("Bot %s not allowed to post to channel %s", c.engineName, channel)
+			return
+		}
+		if len(m.Text) == 0 {
+			return
+		}
+		cm.post(&message.Message{
+			Text:           m.Text,
+			ChannelId:      channel,
+			ThreadId:       params.Get("thread"),
+			ExpandMentions: c.expandMentions,
+			ExpandNewlines: lineFraming(c.outputFraming),
+		})
+		return
+	}
+
+	// Remember messages posted by the bot, along with any label given
+	ref := ""
+	if command == ConversationCommandRef || command == ConversationCommandEdit {
+		ref = arg
+	}
+	m.Posted = func(timestamp string) {
+		c.history.addPosted(timestamp, ref)
+	}
+
+	m.ResponseURL = c.responseURL
+	m.ExpandMentions = c.expandMentions
+	m.ExpandNewlines = lineFraming(c.outputFraming)
+
+	if command == ConversationCommandSwitchThread || (c.pendingThread && m.Text != "..." && startsThread(m)) {
 		// Need the new thread ID
 		m.NeedThreadId = true
 		m.ThreadIdChan = make(chan string, 1)
 	}
 
-	// Send message to backend
-	cm.backendQueues.RespQ <- m
+	cm.post(m)
 
 	if m.NeedThreadId {
-		// Wait for thread ID
+		// Wait for thread ID. The message may be queued behind others to
+		// the channel, so there's no telling how long posting it takes.
 		select {
 		case m.ThreadId = <-m.ThreadIdChan:
 			logrus.Debugf("Got thread ID: %s", m.ThreadId)
-		case <-time.After(5 * time.Second):
-			logrus.Warnf("Timeout waiting for thread ID: bot=%s channel=%s",
+		case <-ctx.Done():
+			logrus.Debugf("Stopped waiting for thread ID: bot=%s channel=%s",
 				c.engineName, c.channelName)
 			return
 		}
+	}
 
+	if c.pendingThread && m.ThreadId != "" {
+		// The bot's first message has started the conversation thread
+		logrus.Debugf("Started thread for %s: channel=%s thread=%s",
+			c.engineName, m.ChannelId, m.ThreadId)
+		cm.convLock.Lock()
+		cm.setThreadConversation(m.ThreadId, c)
+		c.threadId = m.ThreadId
+		c.pendingThread = false
+		cm.convLock.Unlock()
 	}
 
 	switch command {
@@ -401,8 +1199,12 @@ func (cm *Manager) Post(c *Conversation, m *message.Message) {
 		logrus.Debugf("Switching to channel conversation for %s", c.engineName)
 		cm.convLock.Lock()
 		cm.channelConvLock.Lock()
-		delete(cm.conversations, m.ThreadId)
+		cm.deleteThreadConversation(m.ThreadId, c)
+		if _, exists := cm.channelConversations[m.ChannelId]; !exists {
+			cm.channelConversations[m.ChannelId] = map[string]*Conversation{}
+		}
 		cm.channelConversations[m.ChannelId][c.engineName] = c
+		c.conversationType = ConversationTypeChannel
 		c.threadId = ""
 		globals.NumThreadedConversations.Dec()
 		globals.NumChannelConversations.Inc()
@@ -410,17 +1212,102 @@ func (cm *Manager) Post(c *Conversation, m *message.Message) {
 		cm.convLock.Unlock()
 
 	case ConversationCommandSwitchThread:
+		if m.ThreadId == "" {
+			logrus.Warnf("No thread to switch to for %s: channel=%s", c.engineName, m.ChannelId)
+			return
+		}
+
 		// Switch to threaded conversation
 		logrus.Debugf("Switching to threaded conversation for %s: channel=%s thread=%s",
 			c.engineName, m.ChannelId, m.ThreadId)
 		cm.convLock.Lock()
 		cm.channelConvLock.Lock()
 		delete(cm.channelConversations[m.ChannelId], c.engineName)
-		cm.conversations[m.ThreadId] = c
+		cm.setThreadConversation(m.ThreadId, c)
+		c.conversationType = ConversationTypeThreaded
 		c.threadId = m.ThreadId
 		globals.NumChannelConversations.Dec()
 		globals.NumThreadedConversations.Inc()
 		cm.channelConvLock.Unlock()
 		cm.convLock.Unlock()
+
+	case ConversationCommandEnd:
+		cm.end(c, arg)
+	}
+}
+
+// Check if posting a message can start a thread. Uploads are posted
+// without waiting for a thread, which the bot's next message starts.
+func startsThread(m *message.Message) bool {
+	switch m.Action {
+	case message.ActionPost, message.ActionUpdate, message.ActionEphemeral:
+		return true
+	}
+	return false
+}
+
+// Replace a conversation with one with another bot, in the same thread or
+// channel. The new bot receives the input passed on by the first bot as its
+// first message.
+func (cm *Manager) handoff(ctx context.Context, c *Conversation, bot string, input string) {
+	if !c.canHandoffTo(bot) {
+		logrus.Warnf("Bot %s not allowed to hand off to %s", c.engineName, bot)
+		return
+	}
+
+	cm.triggerLock.RLock()
+	ef, exists := cm.bots[bot]
+	cm.triggerLock.RUnlock()
+	if !exists {
+		logrus.Warnf("Bot %s handing off to unknown bot: %s", c.engineName, bot)
+		return
+	}
+
+	m := message.Message{
+		Text:          input,
+		BotUserId:     c.origin.BotUserId,
+		BotUserName:   c.origin.BotUserName,
+		ChannelId:     c.channelId,
+		ChannelName:   c.channelName,
+		ChannelType:   c.origin.ChannelType,
+		ThreadId:      c.threadId,
+		InThread:      c.threadId != "",
+		DirectMessage: c.origin.DirectMessage,
+		Locale:        c.origin.Locale,
+		HandoffFrom:   c.engineName,
+	}
+	next := cm.newConversation(ef, &m)
+
+	logrus.Infof("Handing off conversation from %s to %s: channel=%s thread=%s",
+		c.engineName, bot, c.channelId, c.threadId)
+	cm.end(c, "close")
+
+	switch {
+	case c.conversationType == ConversationTypeChannel:
+		// Pass the input on to the bot if already active in the channel
+		next, _ = cm.addChannelConversation(ctx, next, c.channelId)
+	case c.threadId != "":
+		if !cm.addThreadedConversation(ctx, next, c.threadId) {
+			// Pass the input on to the bot already active in the thread
+			next = cm.threadConversation(c.threadId, bot)
+		}
+	default:
+		// The first bot's thread hasn't been started yet
+		next.responseURL = c.responseURL
+		cm.addPendingConversation(ctx, next)
+	}
+
+	if next != nil && input != "" {
+		next.Post(&m)
+	}
+}
+
+// End a conversation at the bot's request, closing its input if asked to
+func (cm *Manager) end(c *Conversation, arg string) {
+	logrus.Debugf("Ending conversation with %s: channel=%s thread=%s",
+		c.engineName, c.channelId, c.threadId)
+	cm.endConversation(c)
+	if arg == "close" {
+		c.closeStdin()
 	}
 }
@@ -0,0 +1,1202 @@
+package conversation
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+	"github.com/venkytv/botmand/backend"
+	"github.com/venkytv/botmand/engine"
+	"github.com/venkytv/botmand/message"
+)
+
+// TestBackend implements the Backender interface. Messages are read from and
+// posted to the backend queues directly by the tests.
+type TestBackend struct{}
+
+func (b TestBackend) Name() string { return "Test" }
+func (b TestBackend) Read()        {}
+func (b TestBackend) Post()        {}
+
+func (b TestBackend) Sanitize(m *message.Message, opts message.SanitizeOptions) *message.Message {
+	return m
+}
+
+func (b TestBackend) DownloadFile(url string, w io.Writer) error {
+	_, err := io.WriteString(w, url)
+	return err
+}
+
+func (b TestBackend) WaitToPost(channelId string) {}
+
+// Names of the channels known to the backend, by ID
+var testChannelNames = map[string]string{
+	"C234567": "general",
+	"C345678": "deploys",
+}
+
+func (b TestBackend) LookupChannel(channelId string) (string, string) {
+	return testChannelNames[channelId], message.ChannelTypeChannel
+}
+
+// The only user group is "oncall", with a single member
+func (b TestBackend) InUserGroup(user string, group string) bool {
+	return group == "oncall" && user == "U345678"
+}
+
+// Create a manager with bots loaded from the given configs, keyed by name
+func newTestManager(ctx context.Context, t *testing.T, configs map[string]string) (*Manager, backend.BackendQueues) {
+	return newTestManagerWithBackend(ctx, t, configs, TestBackend{})
+}
+
+func newTestManagerWithBackend(ctx context.Context, t *testing.T, configs map[string]string, b backend.Backender) (*Manager, backend.BackendQueues) {
+	dir := t.TempDir()
+	for name, config := range configs {
+		err := ioutil.WriteFile(filepath.Join(dir, name+".yaml"), []byte(config), 0644)
+		assert.Nil(t, err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("config-directory", dir, "")
+	cfg := cli.NewContext(cli.NewApp(), flags, nil)
+
+	qs := backend.NewBackendQueues(backend.DefaultQBufferSize)
+	cm := NewManager(ctx, cfg, b, qs)
+
+	return cm, qs
+}
+
+// Start a manager with bots loaded from the given configs, keyed by name
+func startTestManager(ctx context.Context, t *testing.T, configs map[string]string) (*Manager, backend.BackendQueues) {
+	cm, qs := newTestManager(ctx, t, configs)
+	go cm.Start(ctx)
+
+	return cm, qs
+}
+
+// fakeClock implements cron.Clock. Time only passes when advanced.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.now.Add(d), ch: ch})
+	return ch
+}
+
+// Move the clock forward, waking everything waiting until then
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	fc.now = fc.now.Add(d)
+	waiters := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.ch <- fc.now
+		}
+	}
+	fc.waiters = waiters
+}
+
+func (fc *fakeClock) numWaiters() int {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return len(fc.waiters)
+}
+
+// Wait for a message to be posted to the backend
+func expectResponse(t *testing.T, qs backend.BackendQueues) *message.Message {
+	select {
+	case m := <-qs.RespQ:
+		return m
+	case <-time.After(2 * time.Second):
+		assert.FailNow(t, "No response from bot")
+	}
+	return nil
+}
+
+// Check if a threaded conversation exists for a thread
+func hasThread(cm *Manager, threadId string) bool {
+	cm.convLock.RLock()
+	defer cm.convLock.RUnlock()
+
+	return len(cm.conversations[threadId]) > 0
+}
+
+func TestSlashCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"deploybot": "handler: cat\nslash-commands: [/deploy]\nthreaded: true\n",
+		"helpbot":   "handler: cat\nslash-commands: [help]\nslash-command-ephemeral: true\n",
+		"statusbot": "handler: cat\nslash-commands: [/status]\n",
+		"pingbot":   "handler: cat\nslash-commands: [/ping]\nallow-im: false\n",
+		"opsbot":    "handler: cat\nslash-commands: [/ping]\nchannels: [ops]\nallow-im: true\n",
+	})
+
+	t.Run("Threaded", func(t *testing.T) {
+		qs.MesgQ <- &message.Message{
+			Text:        "staging",
+			User:        "U234567",
+			ChannelId:   "C234567",
+			Event:       message.EventSlashCommand,
+			Command:     "/deploy",
+			ResponseURL: "https://hooks.example.com/commands/1",
+		}
+
+		// The bot's first message starts the conversation thread
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "staging", resp.Text)
+		assert.Equal(t, "", resp.ResponseURL)
+		assert.True(t, resp.NeedThreadId)
+		resp.ThreadIdChan <- "1111.2222"
+		assert.Eventually(t, func() bool { return hasThread(cm, "1111.2222") },
+			time.Second, 10*time.Millisecond)
+
+		qs.MesgQ <- &message.Message{
+			Text:      "now production",
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  "1111.2222",
+			InThread:  true,
+		}
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "now production", resp.Text)
+		assert.Equal(t, "1111.2222", resp.ThreadId)
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		qs.MesgQ <- &message.Message{
+			Text:        "botmand://upload?filetype=txt build log",
+			User:        "U234567",
+			ChannelId:   "C234567",
+			Event:       message.EventSlashCommand,
+			Command:     "/deploy",
+			ResponseURL: "https://hooks.example.com/commands/3",
+		}
+
+		// Uploads don't start the conversation thread
+		resp := expectResponse(t, qs)
+		assert.Equal(t, message.ActionUpload, resp.Action)
+		assert.Equal(t, []byte("build log"), resp.Upload.Content)
+		assert.False(t, resp.NeedThreadId)
+	})
+
+	t.Run("Ephemeral", func(t *testing.T) {
+		qs.MesgQ <- &message.Message{
+			Text:        "me",
+			User:        "U234567",
+			ChannelId:   "C234567",
+			Event:       message.EventSlashCommand,
+			Command:     "/help",
+			ResponseURL: "https://hooks.example.com/commands/2",
+		}
+
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "me", resp.Text)
+		assert.Equal(t, "https://hooks.example.com/commands/2", resp.ResponseURL)
+		assert.False(t, resp.NeedThreadId)
+	})
+
+	t.Run("Channel", func(t *testing.T) {
+		for _, text := range []string{"web", "db"} {
+			qs.MesgQ <- &message.Message{
+				Text:      text,
+				User:      "U234567",
+				ChannelId: "C345678",
+				Event:     message.EventSlashCommand,
+				Command:   "/status",
+			}
+
+			// Later commands go to the bot already active in the channel
+			resp := expectResponse(t, qs)
+			assert.Equal(t, text, resp.Text)
+			assert.True(t, hasChannelConversation(cm, "C345678", "statusbot"))
+		}
+	})
+
+	t.Run("DirectMessage", func(t *testing.T) {
+		// Only bots allowed direct messages start from commands in them,
+		// whatever their channels
+		qs.MesgQ <- &message.Message{
+			Text:        "hi",
+			User:        "U234567",
+			ChannelId:   "D234567",
+			ChannelType: message.ChannelTypeIM,
+			Event:       message.EventSlashCommand,
+			Command:     "/ping",
+		}
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "hi", resp.Text)
+		assert.Equal(t, "D234567", resp.ChannelId)
+		expectNoResponse(t, qs)
+		assert.True(t, hasChannelConversation(cm, "D234567", "opsbot"))
+		assert.False(t, hasChannelConversation(cm, "D234567", "pingbot"))
+	})
+}
+
+// Check that nothing more is posted by bots
+func expectNoResponse(t *testing.T, qs backend.BackendQueues) {
+	select {
+	case m := <-qs.RespQ:
+		assert.Fail(t, "Unexpected message", "%q", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMessageCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"echobot": "handler: cat\ndirect-message-triggers-only: false\n",
+	})
+
+	send := func(text string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  timestamp,
+			Timestamp: timestamp,
+		}
+	}
+
+	send("hello", "1111.0001")
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "hello", resp.Text)
+	resp.Posted("2222.0001")
+
+	t.Run("React", func(t *testing.T) {
+		// Punctuation at the end of a command is part of it
+		send("botmand://react/:white_check_mark:", "1111.0002")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, message.ActionReact, resp.Action)
+		assert.Equal(t, "white_check_mark", resp.Reaction)
+		assert.Equal(t, "1111.0002", resp.Timestamp)
+		expectNoResponse(t, qs)
+
+		send("done botmand://react/tada?ts=1111.0001", "1111.0003")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, message.ActionReact, resp.Action)
+		assert.Equal(t, "tada", resp.Reaction)
+		assert.Equal(t, "1111.0001", resp.Timestamp)
+		assert.Equal(t, "done", expectResponse(t, qs).Text)
+	})
+
+	t.Run("RefEditDelete", func(t *testing.T) {
+		send("status: running botmand://ref/status", "1111.0004")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "status: running", resp.Text)
+		assert.Equal(t, message.ActionPost, resp.Action)
+		resp.Posted("2222.0004")
+
+		send("status: done botmand://edit/status", "1111.0005")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "status: done", resp.Text)
+		assert.Equal(t, message.ActionUpdate, resp.Action)
+		assert.Equal(t, "2222.0004", resp.Target())
+
+		send("botmand://edit/last", "1111.0006")
+		expectNoResponse(t, qs)
+
+		send("botmand://delete/status", "1111.0007")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, message.ActionDelete, resp.Action)
+		assert.Equal(t, "2222.0004", resp.Target())
+		expectNoResponse(t, qs)
+	})
+
+	t.Run("Blocks", func(t *testing.T) {
+		payload := `{"text":"Deploy?","blocks":[{"type":"section"}]}`
+		send("botmand://blocks "+payload, "1111.0008")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "Deploy?", resp.Text)
+		assert.Equal(t, payload, string(resp.Blocks))
+
+		send("botmand://blocks not json", "1111.0009")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "not json", resp.Text)
+		assert.Equal(t, "not json", string(resp.Blocks))
+	})
+}
+
+func TestReactionEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"watchbot":  "handler: cat\nthreaded: true\ntriggers: [^watch]\ndirect-message-triggers-only: false\nreactions: true\n",
+		"quietbot":  "handler: cat\nthreaded: true\ntriggers: [^quiet]\ndirect-message-triggers-only: false\n",
+		"prefixbot": "handler: cat\nthreaded: true\ntriggers: [^prefix]\ndirect-message-triggers-only: false\nreactions: true\nevent-prefix: \"event:\"\n",
+	})
+
+	start := func(text string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  timestamp,
+			Timestamp: timestamp,
+		}
+		assert.Equal(t, text, expectResponse(t, qs).Text)
+	}
+	react := func(event int, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			User:      "U345678",
+			ChannelId: "C234567",
+			Timestamp: timestamp,
+			Event:     event,
+			Reaction:  "eyes",
+		}
+	}
+
+	start("watch", "1111.0001")
+	start("quiet", "1111.0002")
+	start("prefix", "1111.0003")
+
+	t.Run("Delivered", func(t *testing.T) {
+		react(message.EventReactionAdded, "1111.0001")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "botmand://reaction/added?reaction=eyes&ts=1111.0001&user=U345678", resp.Text)
+		assert.Equal(t, "1111.0001", resp.ThreadId)
+
+		react(message.EventReactionRemoved, "1111.0001")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "botmand://reaction/removed?reaction=eyes&ts=1111.0001&user=U345678", resp.Text)
+		assert.Equal(t, "1111.0001", resp.ThreadId)
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		react(message.EventReactionAdded, "1111.0002")
+		react(message.EventReactionRemoved, "1111.0002")
+		expectNoResponse(t, qs)
+	})
+
+	t.Run("EventPrefix", func(t *testing.T) {
+		react(message.EventReactionAdded, "1111.0003")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "event:reaction/added?reaction=eyes&ts=1111.0003&user=U345678", resp.Text)
+		assert.Equal(t, "1111.0003", resp.ThreadId)
+	})
+}
+
+func TestEditEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"editbot":  "handler: cat\nthreaded: true\ntriggers: [^watch]\ndirect-message-triggers-only: false\nedits: true\n",
+		"quietbot": "handler: cat\nthreaded: true\ntriggers: [^quiet]\ndirect-message-triggers-only: false\n",
+	})
+
+	send := func(text string, threadId string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  threadId,
+			InThread:  threadId != timestamp,
+			Timestamp: timestamp,
+		}
+		assert.Equal(t, text, expectResponse(t, qs).Text)
+	}
+	edit := func(event int, text string, threadId string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  threadId,
+			InThread:  true,
+			Timestamp: timestamp,
+			Event:     event,
+		}
+	}
+
+	// The same bot in two threads, and a bot not wanting edits in a third
+	send("watch one", "1111.0001", "1111.0001")
+	send("watch two", "1111.0002", "1111.0002")
+	send("quiet", "1111.0003", "1111.0003")
+	send("reply", "1111.0002", "1111.0004")
+	send("reply", "1111.0003", "1111.0005")
+
+	t.Run("Delivered", func(t *testing.T) {
+		// Edits go only to the conversation owning the thread
+		edit(message.EventMessageChanged, "reply, edited", "1111.0002", "1111.0004")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "botmand://message/changed?text=reply%2C+edited&ts=1111.0004&user=U234567", resp.Text)
+		assert.Equal(t, "1111.0002", resp.ThreadId)
+
+		edit(message.EventMessageDeleted, "reply, edited", "1111.0002", "1111.0004")
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "botmand://message/deleted?text=reply%2C+edited&ts=1111.0004&user=U234567", resp.Text)
+		assert.Equal(t, "1111.0002", resp.ThreadId)
+		expectNoResponse(t, qs)
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		edit(message.EventMessageChanged, "reply, edited", "1111.0003", "1111.0005")
+		edit(message.EventMessageDeleted, "reply, edited", "1111.0003", "1111.0005")
+		expectNoResponse(t, qs)
+	})
+}
+
+func TestOutputFraming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"linebot":  "handler: cat\ndirect-message-triggers-only: false\nchannels: [C234567]\n",
+		"blockbot": "handler: cat\ndirect-message-triggers-only: false\nchannels: [C345678]\noutput-framing: blank-line\n",
+	})
+
+	// Only bots posting a line at a time need "\n" escapes expanded
+	qs.MesgQ <- &message.Message{Text: `one\ntwo`, User: "U234567", ChannelId: "C234567"}
+	resp := expectResponse(t, qs)
+	assert.Equal(t, `one\ntwo`, resp.Text)
+	assert.True(t, resp.ExpandNewlines)
+
+	qs.MesgQ <- &message.Message{Text: "```\nprintf(\"x\\n\");\n```\n", User: "U234567", ChannelId: "C345678"}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "```\nprintf(\"x\\n\");\n```", resp.Text)
+	assert.False(t, resp.ExpandNewlines)
+}
+
+func TestEphemeralCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"echobot": "handler: cat\ndirect-message-triggers-only: false\n",
+	})
+
+	qs.MesgQ <- &message.Message{
+		Text:      "secret botmand://ephemeral",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Timestamp: "1111.2222",
+	}
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "secret", resp.Text)
+	assert.Equal(t, message.ActionEphemeral, resp.Action)
+	assert.Equal(t, "U234567", resp.User)
+
+	qs.MesgQ <- &message.Message{
+		Text:      "psst botmand://ephemeral/U345678",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Timestamp: "1111.3333",
+	}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "psst", resp.Text)
+	assert.Equal(t, "U345678", resp.User)
+}
+
+func TestDMCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"echobot": "handler: cat\n",
+	})
+
+	qs.MesgQ <- &message.Message{
+		Text:          "Let's talk in private botmand://dm/U234567",
+		User:          "U234567",
+		ChannelId:     "C234567",
+		ChannelType:   message.ChannelTypeChannel,
+		DirectMessage: true,
+	}
+
+	resp := expectResponse(t, qs)
+	assert.Equal(t, message.ActionOpenIM, resp.Action)
+	assert.Equal(t, "U234567", resp.User)
+	resp.ChannelIdChan <- "D234567"
+
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "Let's talk in private", resp.Text)
+	assert.Equal(t, "D234567", resp.ChannelId)
+	assert.Equal(t, "", resp.ThreadId)
+
+	cm.channelConvLock.RLock()
+	_, inIM := cm.channelConversations["D234567"]["echobot"]
+	_, inChannel := cm.channelConversations["C234567"]["echobot"]
+	cm.channelConvLock.RUnlock()
+	assert.True(t, inIM)
+	assert.False(t, inChannel)
+}
+
+// Check if a channel conversation exists with a bot
+func hasChannelConversation(cm *Manager, channelId string, bot string) bool {
+	cm.channelConvLock.RLock()
+	defer cm.channelConvLock.RUnlock()
+
+	_, exists := cm.channelConversations[channelId][bot]
+	return exists
+}
+
+func TestJoinChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"greeter":  "handler: cat\non-join:\n  message: Hello\n",
+		"listener": "handler: cat\nchannels: [ops]\non-join:\n  start: true\n",
+	})
+
+	qs.MesgQ <- &message.Message{
+		ChannelId:   "C234567",
+		ChannelName: "ops",
+		ChannelType: message.ChannelTypeChannel,
+		Event:       message.EventChannelJoined,
+	}
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "Hello", resp.Text)
+	assert.Equal(t, "C234567", resp.ChannelId)
+	assert.Eventually(t, func() bool { return hasChannelConversation(cm, "C234567", "listener") },
+		time.Second, 10*time.Millisecond)
+
+	// The listener hears messages without being triggered first
+	qs.MesgQ <- &message.Message{
+		Text:        "anyone around?",
+		User:        "U234567",
+		ChannelId:   "C234567",
+		ChannelName: "ops",
+		ChannelType: message.ChannelTypeChannel,
+	}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "anyone around?", resp.Text)
+
+	// Bots only start in the channels they're configured for
+	qs.MesgQ <- &message.Message{
+		ChannelId:   "C345678",
+		ChannelName: "random",
+		ChannelType: message.ChannelTypeChannel,
+		Event:       message.EventChannelJoined,
+	}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "Hello", resp.Text)
+	assert.Equal(t, "C345678", resp.ChannelId)
+	assert.False(t, hasChannelConversation(cm, "C345678", "listener"))
+	assert.False(t, hasChannelConversation(cm, "C234567", "greeter"))
+}
+
+func TestSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	handler := filepath.Join(dir, "standup.sh")
+	err := ioutil.WriteFile(handler, []byte("#!/bin/sh\necho \"$BOTMAND_SCHEDULED_RUN $BOTMAND_CHANNEL $BOTMAND_CHANNEL_TYPE\"\nexec cat\n"), 0755)
+	assert.Nil(t, err)
+
+	cm, qs := newTestManager(ctx, t, map[string]string{
+		"standup": "handler: " + handler + "\n" +
+			"schedule:\n" +
+			"  - cron: 0 9 * * *\n" +
+			"    channels: [C234567]\n" +
+			"    text: standup time\n" +
+			"    skip-if-active: true\n",
+	})
+	clock := &fakeClock{now: time.Date(2023, time.March, 15, 8, 30, 0, 0, time.UTC)}
+	cm.clock = clock
+	go cm.Start(ctx)
+
+	waitForSchedule := func() {
+		assert.Eventually(t, func() bool { return clock.numWaiters() == 1 },
+			time.Second, 10*time.Millisecond)
+	}
+
+	waitForSchedule()
+	clock.Advance(29 * time.Minute)
+	select {
+	case m := <-qs.RespQ:
+		assert.Fail(t, "Bot started early", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	waitForSchedule()
+	clock.Advance(time.Minute)
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "2023-03-15T09:00:00Z general channel", resp.Text)
+	assert.Equal(t, "C234567", resp.ChannelId)
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "standup time", resp.Text)
+
+	// The bot is still running the next day, so the run is skipped
+	waitForSchedule()
+	clock.Advance(24 * time.Hour)
+	waitForSchedule()
+	select {
+	case m := <-qs.RespQ:
+		assert.Fail(t, "Scheduled run not skipped", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reloading restarts the schedules, but leaves the conversations they
+	// started running
+	cm.startSchedules(ctx)
+	// The stopped schedule's timer is still counted
+	assert.Eventually(t, func() bool { return clock.numWaiters() == 2 },
+		time.Second, 10*time.Millisecond)
+	assert.True(t, hasChannelConversation(cm, "C234567", "standup"))
+	qs.MesgQ <- &message.Message{Text: "done", User: "U234567", ChannelId: "C234567"}
+	assert.Equal(t, "done", expectResponse(t, qs).Text)
+}
+
+func TestPostCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, qs := startTestManager(ctx, t, map[string]string{
+		"triagebot": "handler: cat\ndirect-message-triggers-only: false\npost-channels: [\"#incidents\", C345678]\n",
+	})
+
+	qs.MesgQ <- &message.Message{
+		Text:      "botmand://post/#incidents Resolved: disk full on db1",
+		User:      "U234567",
+		ChannelId: "C234567",
+		ThreadId:  "1111.2222",
+		InThread:  true,
+		Timestamp: "1111.3333",
+	}
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "Resolved: disk full on db1", resp.Text)
+	assert.Equal(t, "incidents", resp.ChannelId)
+	assert.Equal(t, "", resp.ThreadId)
+
+	qs.MesgQ <- &message.Message{
+		Text:      "botmand://post/C345678?thread=2222.3333 update",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Timestamp: "1111.4444",
+	}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "update", resp.Text)
+	assert.Equal(t, "C345678", resp.ChannelId)
+	assert.Equal(t, "2222.3333", resp.ThreadId)
+
+	// Channels not in the allowlist are refused
+	qs.MesgQ <- &message.Message{
+		Text:      "botmand://post/general spam",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Timestamp: "1111.5555",
+	}
+	qs.MesgQ <- &message.Message{
+		Text:      "still here",
+		User:      "U234567",
+		ChannelId: "C234567",
+		Timestamp: "1111.6666",
+	}
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "still here", resp.Text)
+	assert.Equal(t, "C234567", resp.ChannelId)
+}
+
+func TestEndCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	closed := filepath.Join(dir, "closed")
+	handler := filepath.Join(dir, "endbot.sh")
+	err := ioutil.WriteFile(handler, []byte("#!/bin/sh\ncat\ntouch "+closed+"\n"), 0755)
+	assert.Nil(t, err)
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"endbot": "handler: " + handler + "\ndirect-message-triggers-only: false\n",
+	})
+
+	start := func(channelId string) {
+		qs.MesgQ <- &message.Message{Text: "hello", User: "U234567", ChannelId: channelId}
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "hello", resp.Text)
+		assert.True(t, hasChannelConversation(cm, channelId, "endbot"))
+	}
+
+	t.Run("KeepInput", func(t *testing.T) {
+		start("C234567")
+		cm.channelConvLock.RLock()
+		c := cm.channelConversations["C234567"]["endbot"]
+		cm.channelConvLock.RUnlock()
+
+		qs.MesgQ <- &message.Message{Text: "bye botmand://end", User: "U234567", ChannelId: "C234567"}
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "bye", resp.Text)
+		assert.Eventually(t, func() bool { return !hasChannelConversation(cm, "C234567", "endbot") },
+			time.Second, 10*time.Millisecond)
+
+		// The bot is still running, but its input is left open
+		time.Sleep(100 * time.Millisecond)
+		_, err := os.Stat(closed)
+		assert.True(t, os.IsNotExist(err))
+
+		// Let the bot exit before the next test, and before its directory is
+		// removed
+		c.closeStdin()
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(closed)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		assert.Nil(t, os.Remove(closed))
+	})
+
+	t.Run("CloseInput", func(t *testing.T) {
+		start("C345678")
+		qs.MesgQ <- &message.Message{Text: "botmand://end/close", User: "U234567", ChannelId: "C345678"}
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(closed)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		assert.False(t, hasChannelConversation(cm, "C345678", "endbot"))
+
+		select {
+		case m := <-qs.RespQ:
+			assert.Fail(t, "Unexpected message", m.Text)
+		default:
+		}
+	})
+}
+
+func TestSwitchCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"channelbot": "handler: cat\ndirect-message-triggers-only: false\nchannels: [C234567]\n",
+		"threadbot":  "handler: cat\nthreaded: true\ndirect-message-triggers-only: false\nchannels: [C345678]\n",
+	})
+
+	send := func(text string, channelId string, threadId string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: channelId,
+			ThreadId:  threadId,
+			InThread:  threadId != "" && threadId != timestamp,
+			Timestamp: timestamp,
+		}
+	}
+
+	t.Run("ToThread", func(t *testing.T) {
+		send("hello", "C234567", "", "1111.1111")
+		assert.Equal(t, "hello", expectResponse(t, qs).Text)
+
+		send("botmand://switch/thread", "C234567", "", "1111.2222")
+		resp := expectResponse(t, qs)
+		assert.True(t, resp.NeedThreadId)
+		resp.ThreadIdChan <- "1111.2222"
+		assert.Eventually(t, func() bool { return hasThread(cm, "1111.2222") },
+			time.Second, 10*time.Millisecond)
+		assert.False(t, hasChannelConversation(cm, "C234567", "channelbot"))
+
+		// Ending the conversation removes it from the thread it switched to
+		send("botmand://end/close", "C234567", "1111.2222", "1111.3333")
+		assert.Eventually(t, func() bool { return !hasThread(cm, "1111.2222") },
+			time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("NoThread", func(t *testing.T) {
+		send("hello", "C234567", "", "1111.4444")
+		assert.Equal(t, "hello", expectResponse(t, qs).Text)
+
+		// Typing indicators can't start the thread, so a message is posted
+		send("botmand://switch/thread ...", "C234567", "", "1111.5555")
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "_..._", resp.Text)
+		assert.True(t, resp.NeedThreadId)
+
+		// The conversation stays in the channel if no thread is started
+		resp.ThreadIdChan <- ""
+		send("still here", "C234567", "", "1111.6666")
+		assert.Equal(t, "still here", expectResponse(t, qs).Text)
+		assert.True(t, hasChannelConversation(cm, "C234567", "channelbot"))
+		assert.False(t, hasThread(cm, ""))
+
+		send("botmand://end/close", "C234567", "", "1111.7777")
+		assert.Eventually(t, func() bool { return !hasChannelConversation(cm, "C234567", "channelbot") },
+			time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("ToChannel", func(t *testing.T) {
+		// The channel has no channel conversations yet
+		send("hello", "C345678", "2222.1111", "2222.1111")
+		assert.Equal(t, "hello", expectResponse(t, qs).Text)
+
+		send("botmand://switch/channel", "C345678", "2222.1111", "2222.2222")
+		assert.Equal(t, "_..._", expectResponse(t, qs).Text)
+		assert.Eventually(t, func() bool { return hasChannelConversation(cm, "C345678", "threadbot") },
+			time.Second, 10*time.Millisecond)
+		assert.False(t, hasThread(cm, "2222.1111"))
+
+		send("botmand://end/close", "C345678", "", "2222.3333")
+		assert.Eventually(t, func() bool { return !hasChannelConversation(cm, "C345678", "threadbot") },
+			time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestHandoffCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	handler := filepath.Join(dir, "deploybot.sh")
+	err := ioutil.WriteFile(handler, []byte("#!/bin/sh\necho \"from $BOTMAND_HANDOFF_FROM\"\nexec cat\n"), 0755)
+	assert.Nil(t, err)
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"triagebot": "handler: cat\nthreaded: true\ntriggers: [^help]\n" +
+			"direct-message-triggers-only: false\nhandoff-to: [deploybot]\n",
+		"deploybot": "handler: " + handler + "\nthreaded: true\ntriggers: [^deploy]\n" +
+			"direct-message-triggers-only: false\n",
+		"dbbot": "handler: cat\nthreaded: true\ntriggers: [^db]\n",
+	})
+
+	qs.MesgQ <- &message.Message{
+		Text:      "help",
+		User:      "U234567",
+		ChannelId: "C234567",
+		ThreadId:  "1111.2222",
+		Timestamp: "1111.2222",
+	}
+	resp := expectResponse(t, qs)
+	assert.Equal(t, "help", resp.Text)
+
+	inThread := func(text string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  "1111.2222",
+			InThread:  true,
+			Timestamp: timestamp,
+		}
+	}
+
+	// Handing off to a bot not in the allowlist leaves the conversation be
+	inThread("botmand://handoff/dbbot", "1111.3333")
+	inThread("botmand://handoff/deploybot ship v1.2", "1111.4444")
+
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "from triagebot", resp.Text)
+	assert.Equal(t, "1111.2222", resp.ThreadId)
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "ship v1.2", resp.Text)
+	assert.Equal(t, "1111.2222", resp.ThreadId)
+
+	cm.convLock.RLock()
+	assert.Contains(t, cm.conversations["1111.2222"], "deploybot")
+	assert.NotContains(t, cm.conversations["1111.2222"], "triagebot")
+	cm.convLock.RUnlock()
+
+	inThread("status?", "1111.5555")
+	resp = expectResponse(t, qs)
+	assert.Equal(t, "status?", resp.Text)
+}
+
+func TestSharedThread(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"triagebot": "handler: cat\nthreaded: true\ntriggers: [^help]\ndirect-message-triggers-only: false\n",
+		"notebot":   "handler: cat\nthreaded: true\ntriggers: [^note]\ndirect-message-triggers-only: false\n",
+		"solobot":   "handler: cat\nthreaded: true\ntriggers: [^solo]\ndirect-message-triggers-only: false\nexclusive: true\n",
+	})
+
+	send := func(text string, threadId string, timestamp string) {
+		qs.MesgQ <- &message.Message{
+			Text:      text,
+			User:      "U234567",
+			ChannelId: "C234567",
+			ThreadId:  threadId,
+			InThread:  threadId != timestamp,
+			Timestamp: timestamp,
+		}
+	}
+	botsInThread := func(threadId string) []string {
+		cm.convLock.RLock()
+		defer cm.convLock.RUnlock()
+		bots := []string{}
+		for bot := range cm.conversations[threadId] {
+			bots = append(bots, bot)
+		}
+		return bots
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		send("help", "1111.0000", "1111.0000")
+		assert.Equal(t, "help", expectResponse(t, qs).Text)
+
+		// Another bot's trigger in the thread brings it in alongside
+		send("note this", "1111.0000", "1111.1111")
+		assert.Equal(t, "note this", expectResponse(t, qs).Text)
+		assert.Equal(t, "note this", expectResponse(t, qs).Text)
+		assert.ElementsMatch(t, []string{"triagebot", "notebot"}, botsInThread("1111.0000"))
+
+		// Exclusive bots don't join threads with other bots
+		send("solo", "1111.0000", "1111.2222")
+		assert.Equal(t, "solo", expectResponse(t, qs).Text)
+		assert.Equal(t, "solo", expectResponse(t, qs).Text)
+		assert.ElementsMatch(t, []string{"triagebot", "notebot"}, botsInThread("1111.0000"))
+
+		// Events go only to the bots which have seen the message
+		eventBots := func(timestamp string) []string {
+			bots := []string{}
+			for _, c := range cm.GetEventConversations(&message.Message{
+				ChannelId: "C234567",
+				ThreadId:  "1111.0000",
+				Timestamp: timestamp,
+				Event:     message.EventBlockAction,
+			}) {
+				bots = append(bots, c.engineName)
+			}
+			return bots
+		}
+		assert.Equal(t, []string{"triagebot"}, eventBots("1111.0000"))
+		assert.ElementsMatch(t, []string{"triagebot", "notebot"}, eventBots("1111.1111"))
+		assert.Equal(t, []string{}, eventBots("1111.9999"))
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		// Other bots don't join threads with exclusive bots
+		send("solo", "2222.0000", "2222.0000")
+		assert.Equal(t, "solo", expectResponse(t, qs).Text)
+		send("help", "2222.0000", "2222.1111")
+		assert.Equal(t, "help", expectResponse(t, qs).Text)
+		assert.Equal(t, []string{"solobot"}, botsInThread("2222.0000"))
+	})
+
+	select {
+	case m := <-qs.RespQ:
+		assert.Fail(t, "Unexpected message", m.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTriggerPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	common := "handler: cat\nthreaded: true\ndirect-message-triggers-only: false\n"
+	cm, _ := newTestManager(ctx, t, map[string]string{
+		"alphabot":    common + "triggers: [deploy]\n",
+		"betabot":     common + "triggers: [deploy]\npriority: 10\nstop-on-match: true\n",
+		"statusbot":   common + "triggers: [status]\n",
+		"fallbackbot": common + "triggers: [.]\nfallback: true\n",
+	})
+
+	// Senders aren't looked up unless triggers match them by name
+	assert.False(t, cm.senderNames)
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"deploy now", []string{"betabot"}},
+		{"deploy status", []string{"betabot"}},
+		{"status", []string{"statusbot"}},
+		{"hello", []string{"fallbackbot"}},
+	}
+	for i, test := range tests {
+		// The same message always starts the same bots
+		for j := 0; j < 5; j++ {
+			threadId := fmt.Sprintf("%d.%d", i, j)
+			bots := []string{}
+			for _, c := range cm.GetConversations(ctx, &message.Message{
+				Text:      test.text,
+				User:      "U234567",
+				ChannelId: "C234567",
+				ThreadId:  threadId,
+				Timestamp: threadId,
+			}) {
+				bots = append(bots, c.engineName)
+			}
+			assert.Equal(t, test.want, bots, test.text)
+		}
+	}
+
+	// Bots after a stop-on-match bot don't join threads it is already in
+	bots := []string{}
+	for _, c := range cm.GetConversations(ctx, &message.Message{
+		Text:      "deploy again",
+		User:      "U234567",
+		ChannelId: "C234567",
+		ThreadId:  "0.0",
+		InThread:  true,
+		Timestamp: "0.9",
+	}) {
+		bots = append(bots, c.engineName)
+	}
+	assert.Equal(t, []string{"betabot"}, bots)
+}
+
+func TestTriggerConditions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	handler := filepath.Join(dir, "match.sh")
+	err := ioutil.WriteFile(handler, []byte("#!/bin/sh\necho \"match:$BOTMAND_MATCH_ENV:$BOTMAND_REACTION\"\nexec cat\n"), 0755)
+	assert.Nil(t, err)
+
+	common := "handler: " + handler + "\nthreaded: true\ndirect-message-triggers-only: false\n"
+	cm, qs := newTestManager(ctx, t, map[string]string{
+		"deploybot": common + "triggers:\n" +
+			"  - pattern: deploy (?P<env>\\w+)\n" +
+			"    unless: (?i)dry.?run\n" +
+			"    users: [alice, U456789]\n" +
+			"    in-thread: false\n",
+		"pagebot": common + "triggers:\n" +
+			"  - pattern: page\n" +
+			"    user-groups: [oncall]\n" +
+			"    channel-types: [channel]\n",
+		"releasebot": common + "triggers:\n" +
+			"  - pattern: release\n" +
+			"    users: [alice]\n" +
+			"    user-groups: [oncall]\n",
+		"hoursbot": common + "triggers:\n" +
+			"  - pattern: hours\n" +
+			"    when: '* 9-17 * * mon-fri'\n",
+		"ticketbot": common + "triggers:\n" +
+			"  - reactions: [':ticket:']\n",
+	})
+	assert.True(t, cm.senderNames)
+
+	// A Wednesday
+	clock := &fakeClock{now: time.Date(2023, time.March, 15, 10, 0, 0, 0, time.UTC)}
+	cm.clock = clock
+
+	n := 0
+	check := func(m message.Message, want []string, response string) {
+		n++
+		m.ChannelId = "C234567"
+		if m.ChannelType == "" {
+			m.ChannelType = message.ChannelTypeChannel
+		}
+		m.Timestamp = fmt.Sprintf("%d.0000", n)
+		if !m.InThread {
+			m.ThreadId = m.Timestamp
+		}
+
+		var conversations []*Conversation
+		if m.Event == message.EventReactionAdded {
+			conversations = cm.GetReactionConversations(ctx, &m)
+		} else {
+			conversations = cm.GetConversations(ctx, &m)
+		}
+		bots := []string{}
+		for _, c := range conversations {
+			bots = append(bots, c.engineName)
+		}
+		assert.Equal(t, want, bots, m.Text)
+
+		if response != "" {
+			assert.Equal(t, response, expectResponse(t, qs).Text)
+		}
+	}
+
+	check(message.Message{Text: "deploy prod", User: "U234567", UserHandle: "alice"}, []string{"deploybot"}, "match:prod:")
+	check(message.Message{Text: "deploy staging", User: "U456789"}, []string{"deploybot"}, "match:staging:")
+	check(message.Message{Text: "deploy prod --dry-run", User: "U234567", UserHandle: "alice"}, []string{}, "")
+	check(message.Message{Text: "deploy prod", User: "U345678", UserHandle: "bob"}, []string{}, "")
+
+	// Display names can be changed by users to anything
+	check(message.Message{Text: "deploy prod", User: "U345678", UserName: "alice", UserHandle: "bob"}, []string{}, "")
+	check(message.Message{Text: "deploy prod", User: "U456789", ThreadId: "999.0000", InThread: true}, []string{}, "")
+
+	check(message.Message{Text: "page", User: "U345678"}, []string{"pagebot"}, "match::")
+	check(message.Message{Text: "page", User: "U234567"}, []string{}, "")
+	check(message.Message{Text: "page", User: "U345678", ChannelType: message.ChannelTypeIM}, []string{}, "")
+
+	// Senders can be either one of the users or in one of the groups
+	check(message.Message{Text: "release", User: "U234567", UserHandle: "alice"}, []string{"releasebot"}, "match::")
+	check(message.Message{Text: "release", User: "U345678", UserHandle: "bob"}, []string{"releasebot"}, "match::")
+	check(message.Message{Text: "release", User: "U456789", UserHandle: "carol"}, []string{}, "")
+
+	check(message.Message{Text: "hours", User: "U234567"}, []string{"hoursbot"}, "match::")
+	clock.Advance(8 * time.Hour)
+	check(message.Message{Text: "hours", User: "U234567"}, []string{}, "")
+
+	check(message.Message{Event: message.EventReactionAdded, Reaction: "ticket", User: "U234567"}, []string{"ticketbot"}, "match::ticket")
+	check(message.Message{Event: message.EventReactionAdded, Reaction: "eyes", User: "U234567"}, []string{}, "")
+	check(message.Message{Text: "ticket", User: "U234567"}, []string{}, "")
+}
+
+func TestInChannels(t *testing.T) {
+	config := &engine.Config{Channels: []string{"general", "C345678"}}
+	allow, deny := true, false
+	imConfig := &engine.Config{Channels: []string{"general"}, AllowIM: &allow}
+	anyConfig := &engine.Config{}
+	noIMConfig := &engine.Config{AllowIM: &deny}
+
+	im := message.Message{ChannelId: "D234567", ChannelType: message.ChannelTypeIM}
+	mpim := message.Message{ChannelId: "G234567", ChannelType: message.ChannelTypeMpIM}
+
+	tests := []struct {
+		config *engine.Config
+		m      message.Message
+		want   bool
+	}{
+		{config, message.Message{ChannelId: "C234567", ChannelName: "general"}, true},
+		{config, message.Message{ChannelId: "C345678", ChannelName: "renamed"}, true},
+		{config, message.Message{ChannelId: "C456789", ChannelName: "random"}, false},
+
+		// Bots limited to channels need to opt in to direct messages
+		{config, im, false},
+		{config, mpim, false},
+		{imConfig, im, true},
+		{imConfig, mpim, true},
+		{imConfig, message.Message{ChannelId: "C456789", ChannelName: "random"}, false},
+		{anyConfig, im, true},
+
+		// Any bot can be kept out of direct messages
+		{noIMConfig, im, false},
+		{noIMConfig, mpim, false},
+		{noIMConfig, message.Message{ChannelId: "C456789", ChannelName: "random"}, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, inChannels(test.config, &test.m), "%+v %s", test.config.Channels, test.m.ChannelId)
+	}
+}
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	// Discard log messages during normal testing
+	logrus.SetOutput(ioutil.Discard)
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,93 @@
+package conversation
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/venkytv/botmand/cron"
+	"github.com/venkytv/botmand/engine"
+	"github.com/venkytv/botmand/message"
+)
+
+// A bot's schedule entry, and the conversations started by its last run
+type scheduledJob struct {
+	ef       engine.EngineFactoryer
+	config   engine.ScheduleConfig
+	schedule *cron.Schedule
+
+	// Conversations started by the last run, by channel
+	last map[string]*Conversation
+}
+
+// Start running the loaded schedules, stopping any already running
+func (cm *Manager) startSchedules(ctx context.Context) {
+	cm.triggerLock.Lock()
+	defer cm.triggerLock.Unlock()
+
+	if cm.stopSchedules != nil {
+		cm.stopSchedules()
+	}
+	ctx, cm.stopSchedules = context.WithCancel(ctx)
+
+	for _, job := range cm.schedules {
+		go cm.runSchedule(ctx, job)
+	}
+}
+
+func (cm *Manager) runSchedule(ctx context.Context, job *scheduledJob) {
+	for {
+		now := cm.clock.Now()
+		next := job.schedule.Next(now)
+		if next.IsZero() {
+			logrus.Warnf("Schedule never fires: %s: %s", job.ef.Config().Name, job.schedule)
+			return
+		}
+
+		select {
+		case <-cm.clock.After(next.Sub(now)):
+			cm.runScheduledJob(job, next)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Start conversations with a bot in each of the channels of a schedule entry.
+// The conversations run under the manager's context, so that they outlive
+// the schedules being restarted on reload.
+func (cm *Manager) runScheduledJob(job *scheduledJob, at time.Time) {
+	config := job.ef.Config()
+	logrus.Infof("Running %s on schedule %s", config.Name, job.schedule)
+
+	for _, channelId := range job.config.Channels {
+		if c := job.last[channelId]; c != nil && c.active() && job.config.SkipIfActive {
+			logrus.Infof("Skipping scheduled run of %s in %s: previous run still active", config.Name, channelId)
+			continue
+		}
+
+		channelName, channelType := cm.backend.LookupChannel(channelId)
+		m := &message.Message{
+			Text:         job.config.Text,
+			ChannelId:    channelId,
+			ChannelName:  channelName,
+			ChannelType:  channelType,
+			Schedule:     job.schedule.String(),
+			ScheduledRun: at,
+		}
+
+		c := cm.newConversation(job.ef, m)
+		if config.Threaded {
+			// The bot's first message starts its thread
+			cm.addPendingConversation(cm.ctx, c)
+		} else {
+			// The bot may already be active in the channel
+			c, _ = cm.addChannelConversation(cm.ctx, c, channelId)
+		}
+		job.last[channelId] = c
+
+		if m.Text != "" {
+			c.Post(m)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package conversation
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/venkytv/botmand/cron"
+	"github.com/venkytv/botmand/engine"
+	"github.com/venkytv/botmand/message"
+)
+
+// A trigger from a bot's config, and the bot it starts
+type trigger struct {
+	re     *regexp.Regexp
+	unless *regexp.Regexp
+	when   *cron.Schedule
+	config engine.TriggerConfig
+	ef     engine.EngineFactoryer
+}
+
+func newTrigger(config engine.TriggerConfig, ef engine.EngineFactoryer) (trigger, error) {
+	t := trigger{config: config, ef: ef}
+
+	var err error
+	if t.re, err = regexp.Compile(config.Pattern); err != nil {
+		return t, err
+	}
+	if config.Unless != "" {
+		if t.unless, err = regexp.Compile(config.Unless); err != nil {
+			return t, err
+		}
+	}
+	if config.When != "" {
+		if t.when, err = cron.Parse(config.When); err != nil {
+			return t, err
+		}
+	}
+
+	return t, nil
+}
+
+// Check if a message matches the trigger, and return the named groups
+// matched by the trigger's pattern
+func (cm *Manager) matchTrigger(t trigger, m *message.Message) (map[string]string, bool) {
+	var match []string
+	if len(t.config.Reactions) > 0 {
+		if m.Event != message.EventReactionAdded || !contains(t.config.Reactions, m.Reaction) {
+			return nil, false
+		}
+	} else {
+		if m.Event != message.EventMessage {
+			return nil, false
+		}
+		if match = t.re.FindStringSubmatch(m.Text); match == nil {
+			return nil, false
+		}
+	}
+
+	if t.unless != nil && t.unless.MatchString(m.Text) {
+		return nil, false
+	}
+
+	if (len(t.config.Users) > 0 || len(t.config.UserGroups) > 0) && !cm.fromTriggerUsers(t, m) {
+		return nil, false
+	}
+
+	if len(t.config.ChannelTypes) > 0 && !contains(t.config.ChannelTypes, m.ChannelType) {
+		return nil, false
+	}
+
+	if t.config.InThread != nil && *t.config.InThread != m.InThread {
+		return nil, false
+	}
+
+	if t.when != nil && !t.when.Matches(cm.clock.Now()) {
+		return nil, false
+	}
+
+	captures := map[string]string{}
+	for i, name := range t.re.SubexpNames() {
+		if name != "" && i < len(match) {
+			captures[name] = match[i]
+		}
+	}
+	return captures, true
+}
+
+// Check if a list of names contains a name. Names can be written with a
+// leading "@" or ":", as for users and reactions in Slack.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if strings.Trim(n, "@:") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a message is from one of a trigger's users, or from a member of one
+// of its user groups
+func (cm *Manager) fromTriggerUsers(t trigger, m *message.Message) bool {
+	// Display names can be chosen by anyone, so users are matched by ID or
+	// account name
+	if contains(t.config.Users, m.User) || (m.UserHandle != "" && contains(t.config.Users, m.UserHandle)) {
+		return true
+	}
+	for _, group := range t.config.UserGroups {
+		if cm.backend.InUserGroup(m.User, group) {
+			return true
+		}
+	}
+	return false
+}
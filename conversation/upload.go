@@ -0,0 +1,131 @@
+package conversation
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/venkytv/botmand/message"
+)
+
+// Build an upload from the parameters of a botmand://upload command.
+//
+// If a "path" parameter is given, that file is uploaded and the message text
+// is used as the upload comment. The file needs to be in the conversation's
+// upload or scratch directory. Otherwise, the message text is the content
+// of the file, base64-encoded if the "encoding" parameter is "base64".
+//
+// Returns the upload and the comment to post with it.
+func (c *Conversation) newUpload(params url.Values, text string) (*message.Upload, string, error) {
+	upload := &message.Upload{
+		Filename: params.Get("filename"),
+		Title:    params.Get("title"),
+		Filetype: params.Get("filetype"),
+	}
+
+	var size int64
+	comment := text
+	if path := params.Get("path"); path != "" {
+		path, err := c.uploadPath(path)
+		if err != nil {
+			return nil, "", err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, "", fmt.Errorf("not a regular file: %s", path)
+		}
+		size = fi.Size()
+
+		upload.Path = path
+		upload.Remove = c.removeUploads
+		if upload.Filename == "" {
+			upload.Filename = filepath.Base(path)
+		}
+	} else {
+		comment = params.Get("comment")
+		switch params.Get("encoding") {
+		case "base64":
+			content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid base64 content: %w", err)
+			}
+			upload.Content = content
+		case "":
+			upload.Content = []byte(text)
+		default:
+			return nil, "", fmt.Errorf("unknown encoding: %s", params.Get("encoding"))
+		}
+		size = int64(len(upload.Content))
+
+		if upload.Filename == "" {
+			upload.Filename = c.engineName
+			if upload.Filetype != "" {
+				upload.Filename += "." + upload.Filetype
+			}
+		}
+	}
+
+	// Slack doesn't accept empty files
+	if size == 0 {
+		return nil, "", fmt.Errorf("empty file")
+	}
+	if size > c.uploadMaxSize {
+		return nil, "", fmt.Errorf("file too large: %d bytes (limit %d)", size, c.uploadMaxSize)
+	}
+	if upload.Title == "" {
+		upload.Title = upload.Filename
+	}
+
+	return upload, comment, nil
+}
+
+// Resolve the path of a file to upload. Paths can come from text the bot
+// passes on from users, so only files in the conversation's upload and
+// scratch directories can be uploaded (and removed once uploaded). Relative
+// paths are relative to the upload directory.
+func (c *Conversation) uploadPath(path string) (string, error) {
+	dirs := []string{}
+	for _, dir := range []string{c.uploadDir, c.scratchDir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) < 1 {
+		return "", fmt.Errorf("no directory to upload files from")
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dirs[0], path)
+	}
+
+	// Resolve symlinks, which could point out of the directories
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		dir, err := resolvePath(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("not in an upload directory: %s", path)
+}
+
+func resolvePath(path string) (string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,97 @@
+package conversation
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpload(t *testing.T) {
+	uploadDir := t.TempDir()
+	scratchDir := t.TempDir()
+	outside := t.TempDir()
+
+	for _, path := range []string{
+		filepath.Join(uploadDir, "report.csv"),
+		filepath.Join(scratchDir, "chart.png"),
+		filepath.Join(outside, "token"),
+	} {
+		assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0644))
+	}
+	assert.Nil(t, os.Mkdir(filepath.Join(uploadDir, "subdir"), 0755))
+	assert.Nil(t, os.Symlink(filepath.Join(outside, "token"), filepath.Join(uploadDir, "link")))
+
+	c := &Conversation{
+		engineName:    "reportbot",
+		uploadMaxSize: 10,
+		uploadDir:     uploadDir,
+		scratchDir:    scratchDir,
+		removeUploads: true,
+	}
+
+	t.Run("Content", func(t *testing.T) {
+		upload, comment, err := c.newUpload(url.Values{"filetype": {"txt"}, "comment": {"notes"}}, "hello")
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello"), upload.Content)
+		assert.Equal(t, "reportbot.txt", upload.Filename)
+		assert.Equal(t, "reportbot.txt", upload.Title)
+		assert.Equal(t, "notes", comment)
+
+		upload, _, err = c.newUpload(url.Values{"encoding": {"base64"}}, "aGVsbG8=\n")
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello"), upload.Content)
+
+		_, _, err = c.newUpload(url.Values{"encoding": {"base64"}}, "not base64!")
+		assert.NotNil(t, err)
+
+		_, _, err = c.newUpload(url.Values{"encoding": {"rot13"}}, "uryyb")
+		assert.NotNil(t, err)
+
+		_, _, err = c.newUpload(url.Values{}, "more than ten bytes")
+		assert.NotNil(t, err)
+
+		_, _, err = c.newUpload(url.Values{"comment": {"nothing"}}, "")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Path", func(t *testing.T) {
+		upload, comment, err := c.newUpload(url.Values{"path": {"report.csv"}}, "Daily report")
+		assert.Nil(t, err)
+		assert.Equal(t, "report.csv", upload.Filename)
+		assert.Equal(t, "Daily report", comment)
+		assert.True(t, upload.Remove)
+		path, _ := resolvePath(filepath.Join(uploadDir, "report.csv"))
+		assert.Equal(t, path, upload.Path)
+
+		upload, _, err = c.newUpload(url.Values{"path": {filepath.Join(scratchDir, "chart.png")}}, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "chart.png", upload.Filename)
+
+		c.uploadMaxSize = 2
+		_, _, err = c.newUpload(url.Values{"path": {"report.csv"}}, "")
+		assert.NotNil(t, err)
+		c.uploadMaxSize = 10
+	})
+
+	t.Run("OutsideDirectories", func(t *testing.T) {
+		for _, path := range []string{
+			filepath.Join(outside, "token"),
+			"../" + filepath.Base(outside) + "/token",
+			"link",
+			"subdir",
+			".",
+			"missing",
+		} {
+			_, _, err := c.newUpload(url.Values{"path": {path}}, "")
+			assert.NotNil(t, err, path)
+		}
+
+		// Bots with neither directory can't upload from paths at all
+		_, _, err := (&Conversation{uploadMaxSize: 10}).newUpload(url.Values{"path": {filepath.Join(outside, "token")}}, "")
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,186 @@
+package conversation
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/venkytv/botmand/engine"
+	"github.com/venkytv/botmand/message"
+)
+
+// Largest webhook request body accepted
+const webhookMaxBodySize = 1 << 20
+
+// A bot which can be started by webhook requests
+type webhookBot struct {
+	ef     engine.EngineFactoryer
+	secret string
+}
+
+// Fields of webhook request payloads. All are optional, and the channel and
+// thread can be passed as URL parameters instead.
+type webhookPayload struct {
+	Channel string  `json:"channel"`
+	Thread  string  `json:"thread"`
+	Text    *string `json:"text"`
+}
+
+// Read the shared secret webhook requests for a bot are authenticated with
+func webhookSecret(config *engine.Config) (string, error) {
+	if config.WebhookSecret != "" || config.WebhookSecretFile == "" {
+		return config.WebhookSecret, nil
+	}
+	content, err := os.ReadFile(config.WebhookSecretFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// WebhookHandler returns a handler for webhook requests from external
+// systems, such as CI and alerting, which start conversations with bots.
+// Requests are of the form:
+//
+//	POST /webhooks/<bot>?channel=<channel ID>&thread=<thread ID>
+//	Authorization: Bearer <secret>
+//
+// The "text" field of the JSON body is the bot's first message. Payloads
+// without one are passed to the bot whole, on a single line.
+func (cm *Manager) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+
+		cm.triggerLock.RLock()
+		bot, exists := cm.webhooks[name]
+		cm.triggerLock.RUnlock()
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !exists || subtle.ConstantTimeCompare([]byte(token), []byte(bot.secret)) != 1 {
+			logrus.Warnf("Rejecting webhook request for bot: %s", name)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			logrus.Warnf("Invalid webhook payload for %s: %v", name, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if payload.Channel == "" {
+			payload.Channel = r.URL.Query().Get("channel")
+		}
+		if payload.Thread == "" {
+			payload.Thread = r.URL.Query().Get("thread")
+		}
+		if payload.Channel == "" {
+			http.Error(w, "No channel", http.StatusBadRequest)
+			return
+		}
+
+		var text string
+		if payload.Text != nil {
+			text = *payload.Text
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			text = compact.String()
+		}
+
+		// Look up the channel here, rather than holding up the
+		// conversation manager, so that bots can list channels by name
+		channelName, channelType := cm.backend.LookupChannel(payload.Channel)
+
+		cm.backendQueues.MesgQ <- &message.Message{
+			Text:        text,
+			ChannelId:   payload.Channel,
+			ChannelName: channelName,
+			ChannelType: channelType,
+			ThreadId:    payload.Thread,
+			InThread:    payload.Thread != "",
+			Event:       message.EventWebhook,
+			Bot:         name,
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// Find or start the conversation with the bot a webhook request is for
+func (cm *Manager) GetWebhookConversations(ctx context.Context, m *message.Message) []*Conversation {
+	cm.triggerLock.RLock()
+	bot, exists := cm.webhooks[m.Bot]
+	cm.triggerLock.RUnlock()
+	if !exists {
+		return nil
+	}
+	config := bot.ef.Config()
+
+	if !inChannels(config, m) {
+		logrus.Warnf("Not starting %s from webhook in channel %s: not in bot's channels", config.Name, m.ChannelId)
+		return nil
+	}
+
+	if m.ThreadId != "" {
+		cm.convLock.RLock()
+		threadConvs := cm.conversations[m.ThreadId]
+		c, exists := threadConvs[config.Name]
+		exclusive := config.Exclusive && len(threadConvs) > 0
+		for _, tc := range threadConvs {
+			exclusive = exclusive || tc.exclusive
+		}
+		cm.convLock.RUnlock()
+
+		if exists {
+			return []*Conversation{c}
+		}
+		if exclusive {
+			logrus.Warnf("Thread %s has other bots, not starting exclusive conversation with %s",
+				m.ThreadId, config.Name)
+			return nil
+		}
+
+		// Start the bot in the thread given
+		c = cm.newConversation(bot.ef, m)
+		if !cm.addThreadedConversation(ctx, c, m.ThreadId) {
+			return nil
+		}
+		logrus.Debugf("New threaded conversation with %s from webhook: %+v", config.Name, c)
+		return []*Conversation{c}
+	}
+
+	c := cm.newConversation(bot.ef, m)
+	if config.Threaded {
+		// The bot's first message starts its thread
+		cm.addPendingConversation(ctx, c)
+		logrus.Debugf("New threaded conversation with %s from webhook: %+v", config.Name, c)
+		return []*Conversation{c}
+	}
+
+	// Pass the payload on to the bot if already active in the channel
+	c, added := cm.addChannelConversation(ctx, c, m.ChannelId)
+	if added {
+		logrus.Debugf("New channel conversation with %s from webhook: %+v", config.Name, c)
+	}
+	return []*Conversation{c}
+}
@@ -0,0 +1,109 @@
+package conversation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newWebhookRequest(method string, target string, secret string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return r
+}
+
+func TestWebhook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm, qs := startTestManager(ctx, t, map[string]string{
+		"triage": "handler: cat\nthreaded: true\nwebhook-secret: s3cret\n",
+		"quiet":  "handler: cat\n",
+		"deploy": "handler: cat\nwebhook-secret: d3ploy\nchannels: [C345678]\n",
+		"notify": "handler: cat\nwebhook-secret: n0tify\nchannels: [deploys]\n",
+	})
+	handler := cm.WebhookHandler()
+
+	t.Run("Rejected", func(t *testing.T) {
+		tests := []struct {
+			r    *http.Request
+			want int
+		}{
+			{newWebhookRequest("GET", "/webhooks/triage", "s3cret", ""), http.StatusMethodNotAllowed},
+			{newWebhookRequest("POST", "/webhooks/triage", "", `{"channel":"C234567"}`), http.StatusUnauthorized},
+			{newWebhookRequest("POST", "/webhooks/triage", "wrong", `{"channel":"C234567"}`), http.StatusUnauthorized},
+			{newWebhookRequest("POST", "/webhooks/quiet", "s3cret", `{"channel":"C234567"}`), http.StatusUnauthorized},
+			{newWebhookRequest("POST", "/webhooks/triage", "s3cret", `{"text":"no channel"}`), http.StatusBadRequest},
+			{newWebhookRequest("POST", "/webhooks/triage", "s3cret", `not json`), http.StatusBadRequest},
+		}
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, test.r)
+			assert.Equal(t, test.want, w.Code, test.r.URL.Path)
+		}
+	})
+
+	t.Run("NewThread", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newWebhookRequest("POST", "/webhooks/triage", "s3cret",
+			`{"channel":"C234567","text":"disk full on db1"}`))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		// The bot's first message starts the conversation thread
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "disk full on db1", resp.Text)
+		assert.Equal(t, "C234567", resp.ChannelId)
+		assert.True(t, resp.NeedThreadId)
+		resp.ThreadIdChan <- "1111.2222"
+		assert.Eventually(t, func() bool { return hasThread(cm, "1111.2222") },
+			time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("RawPayload", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newWebhookRequest("POST", "/webhooks/triage?channel=C234567&thread=2222.3333", "s3cret",
+			"{\n  \"status\": \"firing\",\n  \"alerts\": []\n}\n"))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		resp := expectResponse(t, qs)
+		assert.Equal(t, `{"status":"firing","alerts":[]}`, resp.Text)
+		assert.Equal(t, "2222.3333", resp.ThreadId)
+		assert.True(t, hasThread(cm, "2222.3333"))
+	})
+	t.Run("Channels", func(t *testing.T) {
+		// Bots aren't started outside their channels
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newWebhookRequest("POST", "/webhooks/deploy", "d3ploy",
+			`{"channel":"C234567","text":"deploying"}`))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		expectNoResponse(t, qs)
+		assert.False(t, hasChannelConversation(cm, "C234567", "deploy"))
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, newWebhookRequest("POST", "/webhooks/deploy", "d3ploy",
+			`{"channel":"C345678","text":"deploying"}`))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		resp := expectResponse(t, qs)
+		assert.Equal(t, "deploying", resp.Text)
+		assert.Equal(t, "C345678", resp.ChannelId)
+
+		// Channels can be listed by name too
+		for _, channel := range []string{"C234567", "C345678"} {
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, newWebhookRequest("POST", "/webhooks/notify", "n0tify",
+				`{"channel":"`+channel+`","text":"deployed"}`))
+			assert.Equal(t, http.StatusAccepted, w.Code)
+		}
+		resp = expectResponse(t, qs)
+		assert.Equal(t, "deployed", resp.Text)
+		assert.Equal(t, "C345678", resp.ChannelId)
+		expectNoResponse(t, qs)
+	})
+}
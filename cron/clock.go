@@ -0,0 +1,21 @@
+package cron
+
+import "time"
+
+// Clock tells the time, and waits for it to pass. Schedules are run against
+// a Clock so that they can be tested without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the system clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
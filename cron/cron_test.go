@@ -0,0 +1,90 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{
+		"* * * * *",
+		"*/15 9-17 * * mon-fri",
+		"0 9 1,15 * *",
+		"30 2 * jan,jul 7",
+		"5/20 * * * *",
+		"@daily",
+	} {
+		_, err := Parse(spec)
+		assert.Nil(t, err, spec)
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+	} {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	// A Wednesday
+	start := time.Date(2023, time.March, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2023, time.March, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, time.March, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2023, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2023, time.March, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * sat", time.Date(2023, time.March, 18, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2023, time.March, 19, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+
+		// Restricted day of month and day of week match on either
+		{"0 0 20 * fri", time.Date(2023, time.March, 17, 0, 0, 0, 0, time.UTC)},
+
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := Parse(test.spec)
+		assert.Nil(t, err)
+		assert.Equal(t, test.want, s.Next(start), test.spec)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2023, time.March, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want bool
+	}{
+		{"* * * * *", true},
+		{"* 9-17 * * mon-fri", true},
+		{"* 9-17 * * sat,sun", false},
+		{"* 11-17 * * *", false},
+		{"7 10 15 3 *", true},
+		{"8 10 15 3 *", false},
+	}
+	for _, test := range tests {
+		s, err := Parse(test.spec)
+		assert.Nil(t, err)
+		assert.Equal(t, test.want, s.Matches(now), test.spec)
+	}
+}
@@ -18,12 +18,106 @@ type Config struct {
 	Handler                   string            `yaml:"handler" validate:"required"`
 	Environment               map[string]string `yaml:"environment"`
 	Engine                    string            `yaml:"engine" default:"executable"`
-	Triggers                  []string          `yaml:"triggers" default:"[\".\"]"`
+	Triggers                  []TriggerConfig   `yaml:"triggers" default:"[{\"pattern\": \".\"}]" validate:"dive"`
+	Priority                  int               `yaml:"priority" default:"0"`
+	StopOnMatch               bool              `yaml:"stop-on-match" default:"false"`
+	Fallback                  bool              `yaml:"fallback" default:"false"`
 	DirectMessageTriggersOnly bool              `yaml:"direct-message-triggers-only" default:"true"`
 	DirectMessagesOnly        bool              `yaml:"direct-messages-only" default:"false"`
 	Channels                  []string          `yaml:"channels"`
+	AllowIM                   *bool             `yaml:"allow-im"`
 	Threaded                  bool              `yaml:"threaded" default:"false"`
+	Exclusive                 bool              `yaml:"exclusive" default:"false"`
 	PrefixUsername            bool              `yaml:"prefix-username" default:"false"`
+	SanitizeMentions          bool              `yaml:"sanitize-mentions" default:"false"`
+	SanitizeLinks             bool              `yaml:"sanitize-links" default:"false"`
+	SanitizeEntities          bool              `yaml:"sanitize-entities" default:"false"`
+	ExpandMentions            bool              `yaml:"expand-mentions" default:"false"`
+	OutputFraming             string            `yaml:"output-framing" default:"line" validate:"oneof=line blank-line terminator"`
+	OutputTerminator          string            `yaml:"output-terminator" default:"."`
+	MaxLineSize               int               `yaml:"max-line-size" default:"1048576" validate:"min=1"`
+	UploadMaxSize             int64             `yaml:"upload-max-size" default:"10485760"`
+	UploadDirectory           string            `yaml:"upload-directory"`
+	RemoveUploads             bool              `yaml:"remove-uploads" default:"false"`
+	Files                     bool              `yaml:"files" default:"false"`
+	DownloadFiles             bool              `yaml:"download-files" default:"false"`
+	DownloadMaxSize           int64             `yaml:"download-max-size" default:"10485760"`
+	Reactions                 bool              `yaml:"reactions" default:"false"`
+	Edits                     bool              `yaml:"edits" default:"false"`
+	EventPrefix               string            `yaml:"event-prefix"`
+	SlashCommands             []string          `yaml:"slash-commands"`
+	SlashCommandEphemeral     bool              `yaml:"slash-command-ephemeral" default:"false"`
+	OnJoin                    OnJoinConfig      `yaml:"on-join"`
+	Schedule                  []ScheduleConfig  `yaml:"schedule" validate:"dive"`
+	WebhookSecret             string            `yaml:"webhook-secret"`
+	WebhookSecretFile         string            `yaml:"webhook-secret-file"`
+	PostChannels              []string          `yaml:"post-channels"`
+	HandoffTo                 []string          `yaml:"handoff-to"`
+}
+
+// A condition which starts the bot. Triggers can also be given as just a
+// pattern.
+type TriggerConfig struct {
+	// Regex the text of messages must match. Named groups are passed to the
+	// bot in its environment.
+	Pattern string `yaml:"pattern"`
+
+	// Regex the text of messages must not match
+	Unless string `yaml:"unless"`
+
+	// Users, by ID or account name (not display name), and user groups,
+	// by ID or handle. The sender must be one of the users or a member of
+	// one of the groups.
+	Users      []string `yaml:"users"`
+	UserGroups []string `yaml:"user-groups"`
+
+	// Types of channel the message must be in
+	ChannelTypes []string `yaml:"channel-types" validate:"dive,oneof=channel group im mpim"`
+
+	// If set, whether the message must be in a thread or not
+	InThread *bool `yaml:"in-thread"`
+
+	// Cron expression for the times the trigger is active, e.g.,
+	// "* 9-17 * * mon-fri"
+	When string `yaml:"when"`
+
+	// Reactions which start the bot when added to a message. Triggers with
+	// reactions don't match messages.
+	Reactions []string `yaml:"reactions"`
+}
+
+func (t *TriggerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.Pattern); err == nil {
+		return nil
+	}
+
+	type plain TriggerConfig
+	return unmarshal((*plain)(t))
+}
+
+// When a bot is started on a timer
+type ScheduleConfig struct {
+	// Cron expression, e.g., "0 9 * * mon-fri"
+	Cron string `yaml:"cron" validate:"required"`
+
+	// IDs of the channels the bot is started in
+	Channels []string `yaml:"channels" validate:"required,min=1"`
+
+	// First message passed to the bot, if any
+	Text string `yaml:"text"`
+
+	// Don't start the bot in a channel if the conversation started by the
+	// previous run is still active
+	SkipIfActive bool `yaml:"skip-if-active"`
+}
+
+// What a bot does when botmand is invited to a channel the bot can be used in
+type OnJoinConfig struct {
+	// Message posted to the channel
+	Message string `yaml:"message"`
+
+	// Start a conversation with the bot, without waiting for a trigger
+	Start bool `yaml:"start" default:"false"`
 }
 
 func ConfigInit() {
@@ -35,4 +35,19 @@ var (
 		Name: BotName + "_channel_conversations_total",
 		Help: "Total number of current channel conversations.",
 	})
+
+	NumPostWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: BotName + "_post_workers_total",
+		Help: "Total number of per-channel post workers.",
+	})
+
+	PostQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: BotName + "_post_queue_depth",
+		Help: "Number of messages waiting to be posted to the backend.",
+	})
+
+	PostQueueBlocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: BotName + "_post_queue_blocked_total",
+		Help: "Number of times posting a message blocked on a full queue.",
+	})
 )
@@ -8,7 +8,7 @@ require (
 	github.com/go-playground/validator/v10 v10.12.0
 	github.com/prometheus/client_golang v1.13.0
 	github.com/sirupsen/logrus v1.8.1
-	github.com/slack-go/slack v0.10.2
+	github.com/slack-go/slack v0.12.5
 	github.com/stretchr/testify v1.8.2
 	github.com/urfave/cli/v2 v2.25.1
 	gopkg.in/yaml.v2 v2.4.0
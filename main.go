@@ -91,6 +91,23 @@ func main() {
 				Value:   2112,
 				Aliases: []string{"p"},
 			},
+			&cli.StringFlag{
+				Name:  "http-address",
+				Usage: "address to listen on for Slack interactivity, slash command, and webhook requests (e.g. \":3000\")",
+			},
+			&cli.StringFlag{
+				Name:  "slack-signing-secret",
+				Usage: "signing secret used to verify requests from slack",
+			},
+			&cli.StringFlag{
+				Name:  "slack-signing-secret-file",
+				Usage: "file containing signing secret used to verify requests from slack",
+			},
+			&cli.IntFlag{
+				Name:  "queue-size",
+				Usage: "size of the backend message queues",
+				Value: backend.DefaultQBufferSize,
+			},
 			&cli.BoolFlag{
 				Name:    "debug",
 				Usage:   "print debug messages",
@@ -133,10 +150,41 @@ func main() {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			beqs := backend.NewBackendQueues()
+			beqs := backend.NewBackendQueues(c.Int("queue-size"))
 			be := backend.NewSlackBackend(&api, &beqs)
 			cm := conversation.NewManager(ctx, c, be, beqs)
 
+			if addr := c.String("http-address"); addr != "" {
+				signingSecret := c.String("slack-signing-secret")
+				if len(signingSecret) < 1 && c.String("slack-signing-secret-file") != "" {
+					secretFile := c.String("slack-signing-secret-file")
+					content, err := ioutil.ReadFile(secretFile)
+					if err != nil {
+						logrus.Fatalf("Failed to open slack signing secret file: %s: %s", secretFile, err)
+					}
+					signingSecret = strings.TrimSpace(string(content))
+				}
+
+				mux := http.NewServeMux()
+				// Requests from slack can't be verified without the signing
+				// secret, but webhooks have secrets of their own
+				if len(signingSecret) > 0 {
+					mux.Handle("/slack/interactions", be.InteractionHandler(signingSecret))
+					mux.Handle("/slack/commands", be.CommandHandler(signingSecret))
+				} else {
+					logrus.Warn("No slack signing secret, not handling interactivity or slash command requests from slack")
+				}
+				mux.Handle("/webhooks/", cm.WebhookHandler())
+				go func() {
+					err := http.ListenAndServe(addr, mux)
+					if errors.Is(err, http.ErrServerClosed) {
+						logrus.Info("HTTP server shutdown")
+					} else {
+						logrus.Warnf("Error starting HTTP server: %s", err)
+					}
+				}()
+			}
+
 			done := make(chan bool)
 			go handleSignals(ctx, cm, c, done)
 			go cm.Start(ctx)
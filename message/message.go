@@ -1,17 +1,156 @@
 package message
 
+import "time"
+
+// Actions requested of the backend
+const (
+	ActionPost = iota
+	ActionUpload
+	ActionReact
+	ActionUpdate
+	ActionDelete
+	ActionEphemeral
+	ActionOpenIM
+)
+
+// Channel types
+const (
+	ChannelTypeChannel = "channel"
+	ChannelTypeGroup   = "group"
+	ChannelTypeIM      = "im"
+	ChannelTypeMpIM    = "mpim"
+)
+
+// Events delivered by the backend
+const (
+	EventMessage = iota
+	EventReactionAdded
+	EventReactionRemoved
+	EventMessageChanged
+	EventMessageDeleted
+	EventBlockAction
+	EventSlashCommand
+	EventChannelJoined
+	EventWebhook
+)
+
 type Message struct {
 	Text          string
 	User          string
+	UserName      string
+	UserRealName  string
 	BotUserId     string
 	BotUserName   string
 	ChannelId     string
 	ChannelName   string
+	ChannelType   string
 	ThreadId      string
 	InThread      bool
 	DirectMessage bool
 	Locale        string
+	Files         []File
+
+	// Account name of the sender, which unlike the display name in
+	// UserName is unique and can't be changed by the user
+	UserHandle string
+
+	// Timestamp of the message, or of the message acted on for events and
+	// actions which refer to another message
+	Timestamp string
+	Event     int
+	Reaction  string
+
+	// Interactive element acted on, and the value chosen, for block actions
+	ActionId    string
+	ActionValue string
+
+	// Named groups matched by the trigger which started the conversation
+	Matches map[string]string
+
+	// Slash command invoked, for slash commands
+	Command string
+
+	// Name of the bot a webhook request is for
+	Bot string
+
+	// Name of the bot which handed the conversation off, for handoffs
+	HandoffFrom string
+
+	// Schedule which started the conversation, and the time of the run, for
+	// scheduled runs
+	Schedule     string
+	ScheduledRun time.Time
+
+	// URL responses can be posted to, if any. Messages with a response URL
+	// are posted there, visible only to the user who prompted them.
+	ResponseURL string
 
 	NeedThreadId bool
 	ThreadIdChan chan string
+
+	// Channel ID of the IM channel opened, for ActionOpenIM
+	ChannelIdChan chan string
+
+	Action int
+	Upload *Upload
+
+	// Translate plain mentions (@alice, #ops) in Text into the backend's
+	// markup
+	ExpandMentions bool
+
+	// Translate "\n" escapes in Text into newlines, for bots which can only
+	// post a line at a time
+	ExpandNewlines bool
+
+	// Rich message payload (e.g., Slack Block Kit JSON). Backends which
+	// can't render it post Text instead.
+	Blocks []byte
+
+	// Called by the backend with the timestamp of each message posted
+	Posted func(timestamp string)
+
+	// If set, called by the backend to look up the timestamp of the message
+	// acted on, so that actions can refer to messages still being posted
+	Target func() string
+
+	// Called by the backend with the timestamp of each message deleted
+	Deleted func(timestamp string)
+}
+
+// SanitizeOptions select how backend markup in message text is rewritten
+// before it is passed to bots
+type SanitizeOptions struct {
+	// Replace user mentions with display names
+	Mentions bool
+
+	// Unwrap links and channel references
+	Links bool
+
+	// Decode HTML entities
+	Entities bool
+
+	// Look up the names of the sender, which needs a call to the backend
+	// for each new sender
+	Users bool
+}
+
+// Upload describes a file to be uploaded by the backend. The file is read
+// from Path if set, and from Content otherwise.
+type Upload struct {
+	Path     string
+	Content  []byte
+	Filename string
+	Title    string
+	Filetype string
+
+	// Remove the file at Path once it has been uploaded
+	Remove bool
+}
+
+// File describes a file attached to an incoming message
+type File struct {
+	Name     string
+	Mimetype string
+	Size     int64
+	URL      string
 }